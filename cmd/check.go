@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/UCL-RITS/keyscan/internal/keyscan"
+	"github.com/spf13/cobra"
+)
+
+var checkCmd = &cobra.Command{
+	Use:   "check FILE",
+	Short: "Check a single authorized_keys file against the key policy",
+	Long: `check reads one authorized_keys file and reports any line that
+		can't be parsed, any forbidden or known compromised key, any key
+		that falls short of the key strength policy, and any key breaking the
+		option rules, one problem per line.
+
+		Duplicates aren't checked, since that needs the whole system's keys.
+		It exits with the same statuses as scan, so it can be used to check
+		a file before it's uploaded.
+		`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		failOn, err := failOnSeverity(cmd)
+		if err != nil {
+			return err
+		}
+		runCheck(args[0], failOn)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+}
+
+func runCheck(filename string, failOn keyscan.Severity) {
+	p := scanParamsFromConfig()
+	// Whoever owns the file being checked, they shouldn't get a free pass.
+	p.IgnoredOwners = []string{}
+	p.IgnoredGroups = []string{}
+	p.ScannedGroups = []string{}
+	p.LowerUIDBound = 0
+	for i, r := range p.UIDRanges {
+		if r.Action == keyscan.UIDRangeIgnore {
+			p.UIDRanges[i].Action = keyscan.UIDRangeScan
+		}
+	}
+
+	ctx := &keyscan.ScanContext{Params: p}
+	ctx.GatherKeysToScanFromFiles([]string{filename})
+	ctx.GatherForbiddenKeysFromFiles(p.ForbiddenKeyFiles)
+	ctx.GatherPermittedKeysFromFiles(p.PermittedKeyFiles)
+	ctx.GatherWeakKeyBlacklistFromFiles(p.WeakKeyBlacklistFiles)
+	ctx.ScanKeysForProblems()
+
+	for _, line := range problemLines(ctx.Problems) {
+		fmt.Println(line.text)
+	}
+	exitForScan(ctx, failOn)
+}
+
+type problemLine struct {
+	file string
+	line int
+	text string
+}
+
+// problemLines formats the per-key problems in a ProblemSet as compiler-style "file:line: problem" lines,
+//  sorted by file and line.
+func problemLines(ps keyscan.ProblemSet) []problemLine {
+	lines := make([]problemLine, 0)
+	for _, m := range ps.MalformedEntries {
+		lines = append(lines, problemLine{m.SourceFile, m.SourceLine,
+			fmt.Sprintf("%s:%d: %s: %s", m.SourceFile, m.SourceLine, keyscan.GetProblemTypeText(m.ProblemType), m.Error)})
+	}
+	for _, m := range ps.OwnershipMismatches {
+		lines = append(lines, problemLine{m.SourceFile, 0,
+			fmt.Sprintf("%s: %s: owned by %s, grants access to %s", m.SourceFile, keyscan.GetProblemTypeText(m.ProblemType), m.FileOwner, m.Account)})
+	}
+	for _, e := range ps.ExpiredExemptions {
+		lines = append(lines, problemLine{e.Exemption.SourceFile, 0,
+			fmt.Sprintf("%s: %s: entry %d for %s expired on %s", e.Exemption.SourceFile, keyscan.GetProblemTypeText(e.ProblemType), e.Exemption.SourceEntry, e.Exemption.Fingerprint, e.Exemption.Expires)})
+	}
+	keyProblems := append(append(append(append([]keyscan.PubKeyProblem{}, ps.ForbiddenKeys...), ps.WeakKeys...), ps.CertificateProblems...), ps.OptionProblems...)
+	for _, p := range keyProblems {
+		k := p.ProblemKey
+		text := fmt.Sprintf("%s:%d: %s", k.SourceFile, k.SourceLine, keyscan.GetProblemTypeText(p.ProblemType))
+		if p.Detail != "" {
+			text += ": " + p.Detail
+		}
+		text += fmt.Sprintf(" (%s)", k.Fingerprint())
+		lines = append(lines, problemLine{k.SourceFile, k.SourceLine, text})
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		if lines[i].file != lines[j].file {
+			return lines[i].file < lines[j].file
+		}
+		return lines[i].line < lines[j].line
+	})
+	return lines
+}
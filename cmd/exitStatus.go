@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/UCL-RITS/keyscan/internal/keyscan"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Exit statuses, so that scheduled scans can tell what happened without parsing the report.
+const (
+	exitClean     = 0 // Nothing at or above the --fail-on severity was found.
+	exitProblems  = 1 // Problems at or above the --fail-on severity were found.
+	exitScanError = 2 // Something couldn't be read or looked up, so the scan may have missed things. Takes precedence.
+)
+
+// failOnSeverity returns the lowest severity of problem that should make keyscan exit with exitProblems.
+// Commands that scan check it before they start, so that a typo in it doesn't waste a whole scan.
+func failOnSeverity(cmd *cobra.Command) (keyscan.Severity, error) {
+	s, err := keyscan.ParseSeverity(viper.GetString("fail_on"))
+	if err != nil {
+		cmd.SilenceUsage = true // It may be from the config file rather than a flag, so the usage won't help
+	}
+	return s, err
+}
+
+// exitForScan exits with the status that describes how a scan went.
+func exitForScan(ctx *keyscan.ScanContext, failOn keyscan.Severity) {
+	if ctx.HasErrors() {
+		os.Exit(exitScanError)
+	}
+	if ctx.Problems.AnyAtOrAbove(failOn) {
+		os.Exit(exitProblems)
+	}
+	os.Exit(exitClean)
+}
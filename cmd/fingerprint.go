@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/UCL-RITS/keyscan/internal/keyscan"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+var fingerprintMD5 bool
+
+var fingerprintCmd = &cobra.Command{
+	Use:   "fingerprint FILE",
+	Short: "List every key in an authorized_keys file with its type, size and fingerprint",
+	Long: `fingerprint lists every key in an authorized_keys file, one per line, as:
+
+		LINE BITS FINGERPRINT COMMENT (TYPE)
+
+		which is the same as ssh-keygen -l, with the line number added.
+		`,
+	Args: cobra.ExactArgs(1),
+	Run:  func(cmd *cobra.Command, args []string) { runFingerprint(args[0]) },
+}
+
+func init() {
+	rootCmd.AddCommand(fingerprintCmd)
+	fingerprintCmd.Flags().BoolVar(&fingerprintMD5, "md5", false, "show MD5 fingerprints instead of SHA256")
+}
+
+func runFingerprint(filename string) {
+	ctx := &keyscan.ScanContext{Params: scanParamsFromConfig()}
+	ctx.GatherKeysToScanFromFiles([]string{filename})
+	if ctx.HasErrors() {
+		os.Exit(exitScanError)
+	}
+
+	for _, k := range ctx.FoundKeys {
+		fp := k.Fingerprint()
+		if fingerprintMD5 {
+			fp = "MD5:" + ssh.FingerprintLegacyMD5(k.Key)
+		}
+		comment := k.Comment
+		if comment == "" {
+			comment = "no comment"
+		}
+		fmt.Printf("%d %d %s %s (%s)\n", k.SourceLine, keyscan.KeyBits(k.Key), fp, comment, k.Key.Type())
+	}
+}
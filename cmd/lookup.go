@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/UCL-RITS/keyscan/internal/keyscan"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var lookupCmd = &cobra.Command{
+	Use:   "lookup KEY|FINGERPRINT",
+	Short: "Find everyone on this system who has a given key",
+	Long: `lookup reads every authorized_keys file matched by the configured globs
+		(and sshd_config, if set) and lists everywhere the given key was found, as:
+
+		OWNER UID FILE:LINE COMMENT
+
+		The key can be given in authorized_keys format (quote it, or pass it as
+		several arguments), or as a SHA256:... or MD5:... fingerprint.
+		It exits with status 1 if the key wasn't found, or 2 if some files
+		couldn't be read.
+		`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  func(cmd *cobra.Command, args []string) { runLookup(strings.Join(args, " ")) },
+}
+
+func init() {
+	rootCmd.AddCommand(lookupCmd)
+}
+
+func runLookup(keyOrFingerprint string) {
+	fp, err := keyscan.FingerprintFromKeyOrFingerprint(keyOrFingerprint)
+	if err != nil {
+		log.Fatal("Could not read a key or fingerprint from the arguments: ", err)
+	}
+
+	ctx := &keyscan.ScanContext{Params: scanParamsFromConfig()}
+	ctx.GatherKeysToScan()
+	found := ctx.FindKeysByFingerprint(fp)
+	for _, k := range found {
+		fmt.Printf("%s %d %s:%d %s\n", k.Owner, k.OwnerID, k.SourceFile, k.SourceLine, k.Comment)
+	}
+
+	if ctx.HasErrors() {
+		os.Exit(exitScanError)
+	}
+	if len(found) == 0 {
+		log.WithFields(log.Fields{"fingerprint": fp}).Info("Key not found")
+		os.Exit(exitProblems)
+	}
+}
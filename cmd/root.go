@@ -31,6 +31,7 @@ import (
 
 var cfgFile string
 var logLevel string
+var failOn string
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -38,10 +39,18 @@ var rootCmd = &cobra.Command{
 	Short: "A tool for finding duplicated user public keys",
 	Long: `keyscan is a tool to scan authorized_keys files and report
 		duplicates and forbidden keys.
+
+		Run without a subcommand, it does the same as "keyscan scan".
 		`,
-	// Uncomment the following line if your bare application
-	// has an action associated with it:
-	Run: func(cmd *cobra.Command, args []string) { runScan() },
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		failOn, err := failOnSeverity(cmd)
+		if err != nil {
+			return err
+		}
+		runScan(failOn)
+		return nil
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -49,13 +58,16 @@ var rootCmd = &cobra.Command{
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		os.Exit(exitScanError)
 	}
 }
 
 func init() {
 	cobra.OnInitialize(initConfig)
 
+	// log.Fatal would otherwise exit with 1, which means problems were found.
+	log.StandardLogger().ExitFunc = func(int) { os.Exit(exitScanError) }
+
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
@@ -63,9 +75,14 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default: /etc/keyscan/config.yaml)")
 	rootCmd.PersistentFlags().StringVar(&logLevel, "log_level", "l", "logging level (panic|fatal|error|warn|info|debug|trace) (default: warn)")
 
+	rootCmd.PersistentFlags().StringVar(&failOn, "fail-on", "low", "lowest problem severity that gives a non-zero exit status (low|medium|high|critical)")
+
 	if err := viper.BindPFlag("log_level", rootCmd.PersistentFlags().Lookup("log_level")); err != nil {
 		log.Fatal("Internal problem: unable to bind flag:", err)
 	}
+	if err := viper.BindPFlag("fail_on", rootCmd.PersistentFlags().Lookup("fail-on")); err != nil {
+		log.Fatal("Internal problem: unable to bind flag:", err)
+	}
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -86,9 +103,43 @@ func initConfig() {
 	viper.SetDefault("target_globs", []string{"/home/*/.ssh/authorized_keys", "/home/*/.ssh/authorized_keys2"})
 	viper.SetDefault("permitted_key_files", []string{"/etc/keyscan/permitted_keys"})
 	viper.SetDefault("forbidden_key_files", []string{"/etc/keyscan/forbidden_keys"})
+	viper.SetDefault("weak_key_blacklist_files", []string{})
 	viper.SetDefault("ignored_owners", []string{})
 	viper.SetDefault("lower_uid_bound", 500)
+	viper.SetDefault("uid_ranges", []interface{}{})
+	viper.SetDefault("policy_profiles", map[string]interface{}{})
+	viper.SetDefault("parallelism", 8)
+	viper.SetDefault("file_timeout_seconds", 30)
+	viper.SetDefault("sshd_config_file", "")
+	viper.SetDefault("attribution", "owner")
+	viper.SetDefault("trusted_file_owners", []string{})
+	viper.SetDefault("user_source", "")
+	viper.SetDefault("user_source_file", "")
+	viper.SetDefault("skip_nologin_users", false)
+	viper.SetDefault("user_directory", "os")
+	viper.SetDefault("passwd_file", "")
+	viper.SetDefault("group_file", "")
+	viper.SetDefault("ldap_url", "")
+	viper.SetDefault("ldap_bind_dn", "")
+	viper.SetDefault("ldap_bind_password_file", "")
+	viper.SetDefault("ldap_user_base_dn", "")
+	viper.SetDefault("ldap_group_base_dn", "")
+	viper.SetDefault("ldap_start_tls", false)
+	viper.SetDefault("ldap_ca_cert_file", "")
+	viper.SetDefault("ldap_timeout_seconds", 10)
+	viper.SetDefault("ignored_groups", []string{})
+	viper.SetDefault("scanned_groups", []string{})
+	viper.SetDefault("sharing_groups", []string{})
+	viper.SetDefault("permitted_cert_authorities", []string{})
+	viper.SetDefault("shared_factor_analysis", false)
+	viper.SetDefault("option_rules", []interface{}{})
+	viper.SetDefault("allowed_from_networks", []string{})
+	viper.SetDefault("allowed_key_types", []string{})
+	viper.SetDefault("forbid_dsa_keys", true)
+	viper.SetDefault("min_rsa_bits", 2048)
+	viper.SetDefault("allowed_ecdsa_curves", []string{"nistp256", "nistp384", "nistp521"})
 	viper.SetDefault("log_level", "warn")
+	viper.SetDefault("fail_on", "low")
 
 	viper.AutomaticEnv() // read in environment variables that match
 
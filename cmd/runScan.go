@@ -1,21 +1,195 @@
 package cmd
 
 import (
+	"strings"
+
 	"github.com/UCL-RITS/keyscan/internal/keyscan"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
-func runScan() {
-	// This is the default, and only, command.
-	p := keyscan.ScanParams{
-		TargetGlobs:       viper.GetStringSlice("target_globs"),
-		PermittedKeyFiles: viper.GetStringSlice("permitted_key_files"),
-		ForbiddenKeyFiles: viper.GetStringSlice("forbidden_key_files"),
-		IgnoredOwners:     viper.GetStringSlice("ignored_owners"),
-		LowerUIDBound:     viper.GetInt("lower_uid_bound"),
+// scanParamsFromConfig gathers up the settings every subcommand needs from the config file, defaults and flags.
+func scanParamsFromConfig() keyscan.ScanParams {
+	params := keyscan.ScanParams{
+		ConfigFile:               viper.ConfigFileUsed(),
+		TargetGlobs:              viper.GetStringSlice("target_globs"),
+		PermittedKeyFiles:        viper.GetStringSlice("permitted_key_files"),
+		ForbiddenKeyFiles:        viper.GetStringSlice("forbidden_key_files"),
+		WeakKeyBlacklistFiles:    viper.GetStringSlice("weak_key_blacklist_files"),
+		IgnoredOwners:            viper.GetStringSlice("ignored_owners"),
+		LowerUIDBound:            viper.GetInt("lower_uid_bound"),
+		UIDRanges:                uidRanges(),
+		PolicyProfiles:           policyProfiles(),
+		Parallelism:              viper.GetInt("parallelism"),
+		FileTimeout:              viper.GetInt("file_timeout_seconds"),
+		SSHDConfigFile:           viper.GetString("sshd_config_file"),
+		Attribution:              attributionMode(),
+		TrustedFileOwners:        viper.GetStringSlice("trusted_file_owners"),
+		UserSource:               userSource(),
+		UserSourceFile:           viper.GetString("user_source_file"),
+		SkipNologinUsers:         viper.GetBool("skip_nologin_users"),
+		KeyPolicy:                keyPolicy(viper.GetViper(), keyscan.KeyPolicy{}),
+		DirectoryParams:          directoryParams(),
+		IgnoredGroups:            viper.GetStringSlice("ignored_groups"),
+		ScannedGroups:            viper.GetStringSlice("scanned_groups"),
+		SharingGroups:            viper.GetStringSlice("sharing_groups"),
+		PermittedCertAuthorities: permittedCertAuthorities(),
+		SharedFactorAnalysis:     viper.GetBool("shared_factor_analysis"),
+		OptionRules:              optionRules(),
+		AllowedFromNetworks:      allowedFromNetworks(),
+	}
+	if err := params.CheckUIDRanges(); err != nil {
+		log.Fatal(err)
+	}
+	return params
+}
+
+// keyPolicy reads the key policy settings from v, using base for any that aren't set there,
+//  so that a policy profile only needs to give the settings it changes.
+func keyPolicy(v *viper.Viper, base keyscan.KeyPolicy) keyscan.KeyPolicy {
+	kp := base
+	if v.IsSet("allowed_key_types") {
+		kp.AllowedKeyTypes = v.GetStringSlice("allowed_key_types")
+	}
+	if v.IsSet("forbid_dsa_keys") {
+		kp.ForbidDSAKeys = v.GetBool("forbid_dsa_keys")
+	}
+	if v.IsSet("min_rsa_bits") {
+		kp.MinRSABits = v.GetInt("min_rsa_bits")
+	}
+	if v.IsSet("allowed_ecdsa_curves") {
+		kp.AllowedECDSACurves = v.GetStringSlice("allowed_ecdsa_curves")
+	}
+	return kp
+}
+
+// policyProfiles reads each of the named key policies under policy_profiles, on top of the main key policy.
+// Profile names are lowercased, as viper does with every key.
+func policyProfiles() map[string]keyscan.KeyPolicy {
+	base := keyPolicy(viper.GetViper(), keyscan.KeyPolicy{})
+	profiles := make(map[string]keyscan.KeyPolicy)
+	for name := range viper.GetStringMap("policy_profiles") {
+		sub := viper.Sub("policy_profiles." + name)
+		if sub == nil {
+			log.Fatalf("policy profile %q must be a map of key policy settings", name)
+		}
+		profiles[name] = keyPolicy(sub, base)
+	}
+	return profiles
+}
+
+// uidRanges reads and checks the list of UID ranges, e.g. {uids: "60000-65000", action: profile, profile: service}
+func uidRanges() []keyscan.UIDRange {
+	var config []struct {
+		UIDs    string `mapstructure:"uids"`
+		Action  string `mapstructure:"action"`
+		Profile string `mapstructure:"profile"`
+	}
+	if err := viper.UnmarshalKey("uid_ranges", &config); err != nil {
+		log.Fatal("invalid uid_ranges: ", err)
+	}
+	ranges := make([]keyscan.UIDRange, 0, len(config))
+	for _, c := range config {
+		r, err := keyscan.ParseUIDRange(c.UIDs, c.Action, strings.ToLower(c.Profile))
+		if err != nil {
+			log.Fatal(err)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// optionRules reads and checks the list of option rules, e.g. {groups: [service-accounts], require: [from, restrict]}
+func optionRules() []keyscan.OptionRule {
+	var config []struct {
+		Users             []string `mapstructure:"users"`
+		Groups            []string `mapstructure:"groups"`
+		UIDs              string   `mapstructure:"uids"`
+		Require           []string `mapstructure:"require"`
+		Forbid            []string `mapstructure:"forbid"`
+		RequireWhenShared []string `mapstructure:"require_when_shared"`
 	}
+	if err := viper.UnmarshalKey("option_rules", &config); err != nil {
+		log.Fatal("invalid option_rules: ", err)
+	}
+	rules := make([]keyscan.OptionRule, 0, len(config))
+	for i, c := range config {
+		r, err := keyscan.ParseOptionRule(c.Users, c.Groups, c.UIDs, c.Require, c.Forbid, c.RequireWhenShared)
+		if err != nil {
+			log.Fatalf("option rule %d: %v", i+1, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// allowedFromNetworks checks that each of the allowed from networks is an address or CIDR network.
+func allowedFromNetworks() []string {
+	networks := viper.GetStringSlice("allowed_from_networks")
+	for _, n := range networks {
+		if _, err := keyscan.ParseNetwork(n); err != nil {
+			log.Fatalf("invalid allowed from network: %v", err)
+		}
+	}
+	return networks
+}
+
+// permittedCertAuthorities turns each permitted CA, given as a fingerprint or a key, into a fingerprint.
+func permittedCertAuthorities() []string {
+	fps := make([]string, 0)
+	for _, ca := range viper.GetStringSlice("permitted_cert_authorities") {
+		fp, err := keyscan.FingerprintFromKeyOrFingerprint(ca)
+		if err != nil {
+			log.Fatalf("invalid permitted certificate authority %q: %v", ca, err)
+		}
+		fps = append(fps, fp)
+	}
+	return fps
+}
+
+// attributionMode checks the attribution setting, since a typo there would quietly change who keys are checked as.
+func attributionMode() keyscan.AttributionMode {
+	m, err := keyscan.ParseAttributionMode(viper.GetString("attribution"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return m
+}
+
+// userSource checks the user source setting, so a bad one stops keyscan before it starts rather than part way through.
+func userSource() string {
+	kind := viper.GetString("user_source")
+	if _, err := keyscan.NewUserSource(kind, viper.GetString("user_source_file")); kind != "" && err != nil {
+		log.Fatal(err)
+	}
+	return kind
+}
+
+// directoryParams gathers the user directory settings and checks them, so that a missing LDAP URL or
+//  unreadable bind password stops keyscan before it starts.
+func directoryParams() keyscan.DirectoryParams {
+	dp := keyscan.DirectoryParams{
+		Directory:            viper.GetString("user_directory"),
+		PasswdFile:           viper.GetString("passwd_file"),
+		GroupFile:            viper.GetString("group_file"),
+		LDAPURL:              viper.GetString("ldap_url"),
+		LDAPBindDN:           viper.GetString("ldap_bind_dn"),
+		LDAPBindPasswordFile: viper.GetString("ldap_bind_password_file"),
+		LDAPUserBaseDN:       viper.GetString("ldap_user_base_dn"),
+		LDAPGroupBaseDN:      viper.GetString("ldap_group_base_dn"),
+		LDAPStartTLS:         viper.GetBool("ldap_start_tls"),
+		LDAPCACertFile:       viper.GetString("ldap_ca_cert_file"),
+		LDAPTimeout:          viper.GetInt("ldap_timeout_seconds"),
+	}
+	if _, err := keyscan.NewUserDirectory(dp); err != nil {
+		log.Fatal(err)
+	}
+	return dp
+}
 
-	ctx := &keyscan.ScanContext{Params: p}
+func runScan(failOn keyscan.Severity) {
+	ctx := &keyscan.ScanContext{Params: scanParamsFromConfig()}
 
 	ctx.Go()
+	exitForScan(ctx, failOn)
 }
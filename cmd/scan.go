@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var scanCmd = &cobra.Command{
+	Use:   "scan",
+	Short: "Scan all the configured key files for problems",
+	Long: `scan reads every authorized_keys file matched by the configured globs,
+		checks the keys for duplicates, forbidden keys and policy problems,
+		and prints a JSON report.
+
+		This is also what keyscan does when run without a subcommand.
+		`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		failOn, err := failOnSeverity(cmd)
+		if err != nil {
+			return err
+		}
+		runScan(failOn)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(scanCmd)
+}
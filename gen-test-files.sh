@@ -25,12 +25,18 @@ kg -C "me@desktop" -f tmp-user_key_2
 kg -C "person@laptop" -f tmp-user_key_3
 kg -C "person@my-desktop" -f tmp-user_key_4
 kg -C "person@other-cluster" -f tmp-user_key_5
+kg -C "person@backup-host" -f tmp-user_key_6
+kg -C "person@build-host" -f tmp-user_key_7
+kg -C "person@anywhere" -f tmp-user_key_8
 
 kg -C "we share this key" -f tmp-shared_key_1 
 kg -C "we share this key also but it's allowed" -f tmp-shared_key_2
 
 kg -C "I used this key on a public cluster unencrypted and now it's banned" -f tmp-banned_key_1
 
+kg -t rsa -b 1024 -C "this key is too small" -f tmp-weak_key_1
+kg -t dsa -C "this key type is deprecated" -f tmp-weak_key_2
+
 echo "# Some comment" >>authorized_keys_1
 echo "# Some other comment" >>authorized_keys_2
 echo "# These are forbidden" >>forbidden_keys
@@ -41,6 +47,11 @@ echo "# Normal user keys" >>authorized_keys_2
 cat tmp-user_key_{1,2}.pub >>authorized_keys_1
 cat tmp-user_key_{3,4,5}.pub >>authorized_keys_2
 
+echo "# Restricted keys" >>authorized_keys_2
+echo "restrict,from=\"10.0.0.0/8\",command=\"rsync --server -vlogDtpre.iLsfxC . /backup/\" $(cat tmp-user_key_6.pub)" >>authorized_keys_2
+echo "environment=\"LD_LIBRARY_PATH=/opt/build/lib\",permitopen=\"*:*\" $(cat tmp-user_key_7.pub)" >>authorized_keys_2
+echo "from=\"192.168.0.0/16,*\" $(cat tmp-user_key_8.pub)" >>authorized_keys_2
+
 echo "# Shared keys" >>authorized_keys_1
 echo "# Shared keys" >>authorized_keys_2
 cat tmp-shared_key_1.pub tmp-shared_key_2.pub >>authorized_keys_1
@@ -52,5 +63,45 @@ cat tmp-banned_key_1.pub >>forbidden_keys
 
 cat tmp-shared_key_2.pub >>permitted_keys
 
+echo "# Weak keys" >>authorized_keys_2
+cat tmp-weak_key_{1,2}.pub >>authorized_keys_2
+
+# There's no way to make a real Debian weak key any more, so pretend this one is, in the openssh-blacklist format:
+#  the last 20 hex digits of the MD5 fingerprint.
+kg -t rsa -b 3072 -C "pretend this key came from Debian's broken OpenSSL" -f tmp-weak_key_3
+cat tmp-weak_key_3.pub >>authorized_keys_2
+echo "# Pretend openssh-blacklist" >blacklist.RSA-3072
+ssh-keygen -l -E md5 -f tmp-weak_key_3.pub | cut -d ' ' -f 2 | tr -d ":" | cut -c 16- >>blacklist.RSA-3072
+
+# ssh-keygen can't make a ROCA key either, so this is a fixed one, with primes built the way Infineon's library builds them.
+echo "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQDHXvnFYrsm7/cw+xGHl7c2vnRNvZG1tJNAM9U/SdpZRO20Dl59NTvOU9gSASMZYJjCAZPm86x6vBgLe5BurEO8eZGwdImugX/d7VwShojchexwXo8x3tdHWWBPebWu7/QVZIhIFkXh+L4p90vDsB2z+g53dzua4beOPS9aVRTPiduoX2BkvzVlwKvpnYeuSq8Tbb5oCigpDMntYpeaekBkdJlwKHS2NHsEdUTjN94+hr/ra5rYNuwyrE0Km94hKs0sWP2XPeaD6fVd5PZmQiHRn+BwHH9uP5khTPKrRgFwsSwrDtjZHpl5HisXFbMRd5X5gtTo6pT7rgrpHtPPMlcV this key has the ROCA structure, so it can be factored" >>authorized_keys_2
+
+# Revoked keys, in a KRL like the ones sshd reads from RevokedKeys.
+kg -C "CA for the test certificates" -f tmp-ca_key
+kg -C "this key is revoked in the KRL" -f tmp-revoked_key_1
+kg -C "this key is revoked in the KRL by its SHA1 hash" -f tmp-revoked_key_2
+kg -C "this key is revoked in the KRL by its SHA256 hash" -f tmp-revoked_key_3
+kg -C "this key's certificate is revoked by serial" -f tmp-revoked_key_4
+kg -C "this key's certificate is revoked by key ID" -f tmp-revoked_key_5
+ssh-keygen -s tmp-ca_key -I "revoked-by-serial" -z 1001 -n person tmp-revoked_key_4.pub
+ssh-keygen -s tmp-ca_key -I "revoked-by-id" -z 2001 -n person tmp-revoked_key_5.pub
+
+{
+  echo "key: $(cat tmp-revoked_key_1.pub)"
+  echo "sha1: $(cat tmp-revoked_key_2.pub)"
+  echo "hash: $(ssh-keygen -l -f tmp-revoked_key_3.pub | cut -d ' ' -f 2)"
+  echo "serial: 1000-1099"
+  echo "id: revoked-by-id"
+} >tmp-krl_spec
+ssh-keygen -k -s tmp-ca_key.pub -f revoked_keys.krl tmp-krl_spec
+
+echo "# Revoked keys" >>authorized_keys_2
+cat tmp-revoked_key_{1,2,3}.pub tmp-revoked_key_{4,5}-cert.pub >>authorized_keys_2
+
+# Two fixed keys from a generator short of entropy, which picked the same prime for both, for shared_factor_analysis to find.
+echo "# Keys sharing a prime" >>authorized_keys_1
+echo "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQCkk9R4Xhzw+P8a0xAQOVGgqGlcmKwW7JuJWUjdSOnbgxcQbYxj6gduoKxjy52NnYZ8xwBFPtfI8egp1Cpb7AM0hcqkK41U9uM94IGjwwirxUCeXvucUIWNfnlly0r3dwEu3AwcBiz5rZ3sWF/L8D32wZDPxgZCBB5YHsqSXPow+Mbg5mLvyhEGf3RqAWfmSsaGg+BQvBwzwvmMH1PehwftE25SLhqNSRrpgJ4Zc9g4tLWQH3CKpAmJ6N9Cvrt0Nq4d/wXI6Ifu4nXw1xqtp9agRCBtjBgVNBLMF6HhYu3V21ZDpKevLo2kWWaNziI3ydIvr7Aj+lKaqO1XefPjvOk3 this key shares a prime with another, so both can be factored" >>authorized_keys_1
+echo "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQCe6S4itM34vKCsboDAE/68cS30yaUHyTQKS+p5Mot3OhvS3LMOiipfXtOkua5ldFVURNr60W+O3MMD8R1wm8g1RT+z/YPlGikUnIbyWcgoCo2rHk7n4tTAVuguUoicWg1MZJk3HT8hR9o4PayXv9Lg+wXDB9c8BwfK5vPNv3Fqt+aDP7jyRFvoXEDYd24CU8jMEASnuTFEFc3/iHMuN1CCGhFkEoRsD6XmJTCALRMahdqfVPj11hlUO88A4EvYpLwOWvqnQZOvwh1mJlA2sQRpYGLY2vATg+OnGWbnuTm5JNTj+1PJ2TvmmAKaxL0BTxxAJretisRcWutxcHWpoPzr this key shares a prime with another, so both can be factored" >>authorized_keys_2
+
 command rm -v tmp-*
 
@@ -0,0 +1,144 @@
+package keyscan
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AttributionMode says who a key is attributed to when checking it, e.g. for ignored owners and the UID bound.
+type AttributionMode string
+
+const (
+	AttributeToAccount AttributionMode = "account" // The account the key grants access to, falling back to the file owner if that's unknown
+	AttributeToOwner   AttributionMode = "owner"   // Whoever owns the file the key is in: the default, and what an empty mode means
+)
+
+// ParseAttributionMode checks an attribution mode from the config.
+func ParseAttributionMode(s string) (AttributionMode, error) {
+	switch m := AttributionMode(strings.ToLower(s)); m {
+	case AttributeToAccount, AttributeToOwner:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid attribution mode %q: must be account or owner", s)
+}
+
+// OwnershipMismatchProblem is a key file owned by someone other than the account it grants access to,
+//  meaning someone else can change who can log in as that account.
+type OwnershipMismatchProblem struct {
+	ProblemType PKProblemType `json:"problem_type"`
+	SourceFile  string        `json:"source_file"`
+	Account     string        `json:"account"`
+	AccountID   int           `json:"account_id"`
+	FileOwner   string        `json:"file_owner"`
+	FileOwnerID int           `json:"file_owner_id"`
+}
+
+// attributeKeyFileResult fills in the account that the keys in a file grant access to, and sets their
+//  Owner according to the attribution mode.
+// The account comes from the target if it says (e.g. from sshd's %u), or otherwise from whose home directory the file is in.
+func (ctx *ScanContext) attributeKeyFileResult(r *KeyFileResult, t TargetFile) {
+	account, accountID := t.User, t.UID
+	if account == "" {
+		if u, ok := homeDirUser(t.Path, ctx.passwdUsers()); ok {
+			account, accountID = u.Name, u.UID
+		}
+	}
+	if account == "" {
+		return
+	}
+
+	for i := range r.Keys {
+		r.Keys[i].Account, r.Keys[i].AccountID = account, accountID
+		if ctx.Params.Attribution == AttributeToAccount {
+			r.Keys[i].Owner, r.Keys[i].OwnerID = account, accountID
+		}
+	}
+	if ctx.Params.Attribution == AttributeToAccount {
+		for i := range r.Malformed {
+			r.Malformed[i].Owner, r.Malformed[i].OwnerID = account, accountID
+		}
+	}
+}
+
+// homeDirUser finds the user whose home directory path is in. If a directory is home to more than one
+//  user it can't say whose the file is, so it doesn't pick any of them.
+// Home directories of / are ignored, since every path is in them.
+func homeDirUser(path string, users []PasswdEntry) (PasswdEntry, bool) {
+	var found PasswdEntry
+	foundHome := ""
+	ambiguous := false
+	for _, u := range users {
+		home := filepath.Clean(u.Home)
+		if home == "/" || home == "." || !strings.HasPrefix(path, home+"/") {
+			continue
+		}
+		switch {
+		case len(home) > len(foundHome):
+			found, foundHome, ambiguous = u, home, false
+		case home == foundHome && u.UID != found.UID:
+			ambiguous = true
+		}
+	}
+	return found, foundHome != "" && !ambiguous
+}
+
+// passwdUsers returns every account from the configured user source, reading it the first time it's needed.
+func (ctx *ScanContext) passwdUsers() []PasswdEntry {
+	if ctx.passwdEntries == nil {
+		var users []PasswdEntry
+		source, err := NewUserSource(ctx.Params.UserSource, ctx.Params.UserSourceFile)
+		if err == nil {
+			users, err = source.Users()
+			log.WithFields(log.Fields{"source": source, "users": len(users)}).Debug("Read users")
+		}
+		if err != nil {
+			ctx.recordScanErrors(ScanError{Path: fmt.Sprint(source), Stage: StageRead, Err: err})
+		}
+		ctx.passwdEntries = append(make([]PasswdEntry, 0, len(users)), users...)
+	}
+	return ctx.passwdEntries
+}
+
+// userDirectory returns the configured user directory, wrapped in a cache for the rest of the scan, making it the
+//  first time it's needed.
+// If it can't be made, that's recorded and os/user is used instead, so that file owners can still be found.
+func (ctx *ScanContext) userDirectory() UserDirectory {
+	if ctx.directory == nil {
+		dir, err := NewUserDirectory(ctx.Params.DirectoryParams)
+		if err != nil {
+			ctx.recordScanErrors(ScanError{Stage: StageOwnerLookup, Err: err})
+			dir = OSUserDirectory{}
+		}
+		log.WithFields(log.Fields{"directory": dir}).Debug("Looking up users")
+		ctx.directory = NewCachingUserDirectory(dir)
+	}
+	return ctx.directory
+}
+
+// FindOwnershipMismatches returns a problem for every key file owned by someone other than the account it grants
+//  access to, unless its owner is one of the trusted file owners, or the account's keys are ignored.
+// It's the account that's checked against the ignore rules, whichever way keys are attributed: with owner
+//  attribution a root-owned /etc/ssh/keys/alice belongs to root, which is usually ignored, but it's alice's file.
+func (ctx *ScanContext) FindOwnershipMismatches() []OwnershipMismatchProblem {
+	problems := make([]OwnershipMismatchProblem, 0)
+	seenFiles := make(map[string]bool)
+	for _, k := range ctx.FoundKeys {
+		if seenFiles[k.SourceFile] {
+			continue
+		}
+		seenFiles[k.SourceFile] = true
+		if k.Account == "" || k.AccountID == k.FileOwnerID {
+			continue
+		}
+		if stringInStringSlice(k.FileOwner, ctx.Params.TrustedFileOwners) || ctx.ShouldIgnoreUser(k.Account, k.AccountID) {
+			continue
+		}
+		log.WithFields(log.Fields{"file": k.SourceFile, "account": k.Account, "file_owner": k.FileOwner}).Debug("Key file owner does not match account")
+		problems = append(problems, OwnershipMismatchProblem{ProblemType: OwnershipMismatch, SourceFile: k.SourceFile,
+			Account: k.Account, AccountID: k.AccountID, FileOwner: k.FileOwner, FileOwnerID: k.FileOwnerID})
+	}
+	return problems
+}
@@ -0,0 +1,53 @@
+package keyscan
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOwnershipMismatchCentralKeyFile(t *testing.T) {
+	const path = "/etc/ssh/keys/alice"
+	mismatches := func(params ScanParams) []OwnershipMismatchProblem {
+		ctx := &ScanContext{Params: params}
+		r := KeyFileResult{Path: path, Keys: []OwnedPubKey{{Owner: "root", OwnerID: 0, FileOwner: "root", FileOwnerID: 0, AccountID: -1,
+			SourceFile: path, SourceLine: 1, Key: testKey(t, 1), Options: ParseKeyOptions(nil), Kind: "key"}}}
+		ctx.attributeKeyFileResult(&r, TargetFile{Path: path, User: "alice", UID: 1000})
+		owner := "root"
+		if params.Attribution == AttributeToAccount {
+			owner = "alice"
+		}
+		if k := r.Keys[0]; k.Owner != owner || k.Account != "alice" || k.AccountID != 1000 {
+			t.Errorf("key attributed to %s, for account %s (%d), want %s's, for alice (1000)", k.Owner, k.Account, k.AccountID, owner)
+		}
+		ctx.FoundKeys = r.Keys
+		ctx.ScanKeysForProblems()
+		return ctx.Problems.OwnershipMismatches
+	}
+	reported := []OwnershipMismatchProblem{{ProblemType: OwnershipMismatch, SourceFile: path,
+		Account: "alice", AccountID: 1000, FileOwner: "root", FileOwnerID: 0}}
+
+	// The defaults: owner attribution, with root below the UID bound and no trusted file owners.
+	defaults := ScanParams{LowerUIDBound: 500}
+	if got := mismatches(defaults); !reflect.DeepEqual(got, reported) {
+		t.Errorf("with the defaults, mismatches = %+v, want %+v", got, reported)
+	}
+	// Ignoring root ignores root's keys, but this file is alice's.
+	rootIgnored := ScanParams{LowerUIDBound: 500, IgnoredOwners: []string{"root"}}
+	if got := mismatches(rootIgnored); !reflect.DeepEqual(got, reported) {
+		t.Errorf("with root ignored, mismatches = %+v, want %+v", got, reported)
+	}
+	accountAttribution := ScanParams{LowerUIDBound: 500, Attribution: AttributeToAccount}
+	if got := mismatches(accountAttribution); !reflect.DeepEqual(got, reported) {
+		t.Errorf("with account attribution, mismatches = %+v, want %+v", got, reported)
+	}
+
+	for _, params := range []ScanParams{
+		{LowerUIDBound: 500, TrustedFileOwners: []string{"root"}},
+		{LowerUIDBound: 500, IgnoredOwners: []string{"alice"}},
+		{LowerUIDBound: 1001},
+	} {
+		if got := mismatches(params); len(got) != 0 {
+			t.Errorf("with %+v, mismatches = %+v, want none", params, got)
+		}
+	}
+}
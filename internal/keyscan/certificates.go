@@ -0,0 +1,120 @@
+package keyscan
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyKind says what an authorized_keys line trusts: a key, a certificate authority, or a certificate.
+type KeyKind string
+
+const (
+	KeyKindPlain         KeyKind = "key"            // The key itself
+	KeyKindCertAuthority KeyKind = "cert-authority" // Any certificate the key signs, with the cert-authority option
+	KeyKindCertificate   KeyKind = "certificate"    // An OpenSSH certificate (*-cert-v01@openssh.com) rather than a plain key
+)
+
+// keyKind works out the kind of a key from the key and the options on its line.
+func keyKind(k ssh.PublicKey, opts KeyOptions) KeyKind {
+	if _, ok := k.(*ssh.Certificate); ok {
+		return KeyKindCertificate
+	}
+	if opts.CertAuthority() {
+		return KeyKindCertAuthority
+	}
+	return KeyKindPlain
+}
+
+// A CertificateDescription is how an OpenSSH certificate's contents appear in a report,
+//  as ssh-keygen -L would show them.
+type CertificateDescription struct {
+	Type            string            `json:"type"` // user or host
+	KeyID           string            `json:"key_id"`
+	Serial          uint64            `json:"serial"`
+	SigningCA       string            `json:"signing_ca"`             // The SHA256 fingerprint of the CA's key
+	Principals      []string          `json:"principals"`             // Empty means any principal, for a user certificate
+	ValidAfter      *time.Time        `json:"valid_after,omitempty"`  // Left out if valid from the beginning of time
+	ValidBefore     *time.Time        `json:"valid_before,omitempty"` // Left out if valid forever
+	CriticalOptions map[string]string `json:"critical_options"`       // e.g. force-command, source-address
+	Extensions      []string          `json:"extensions"`             // e.g. permit-pty, sorted
+}
+
+// DescribeCertificate builds a CertificateDescription for a certificate.
+func DescribeCertificate(cert *ssh.Certificate) *CertificateDescription {
+	cd := &CertificateDescription{
+		Type:            "user",
+		KeyID:           cert.KeyId,
+		Serial:          cert.Serial,
+		SigningCA:       KeyFingerprint(cert.SignatureKey),
+		Principals:      cert.ValidPrincipals,
+		CriticalOptions: cert.CriticalOptions,
+		Extensions:      make([]string, 0, len(cert.Extensions)),
+	}
+	if cert.CertType == ssh.HostCert {
+		cd.Type = "host"
+	}
+	if cd.Principals == nil {
+		cd.Principals = []string{}
+	}
+	if cd.CriticalOptions == nil {
+		cd.CriticalOptions = map[string]string{}
+	}
+	for name := range cert.Extensions {
+		cd.Extensions = append(cd.Extensions, name)
+	}
+	sort.Strings(cd.Extensions)
+	if cert.ValidAfter != 0 {
+		t := time.Unix(int64(cert.ValidAfter), 0)
+		cd.ValidAfter = &t
+	}
+	if t, ok := certExpiry(cert); ok {
+		cd.ValidBefore = &t
+	}
+	return cd
+}
+
+// certExpiry returns the first moment a certificate is no longer valid, or false if it's valid forever.
+func certExpiry(cert *ssh.Certificate) (time.Time, bool) {
+	// Anything past the largest int64 would wrap round to the past, and is forever as far as we're concerned.
+	if cert.ValidBefore == ssh.CertTimeInfinity || cert.ValidBefore > 1<<63-1 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(cert.ValidBefore), 0), true
+}
+
+// CheckCertificates returns a problem if k is a cert-authority key that isn't in PermittedCertAuthorities,
+//  or a certificate that has expired.
+func (ctx *ScanContext) CheckCertificates(k OwnedPubKey) []PubKeyProblem {
+	problems := make([]PubKeyProblem, 0)
+	switch k.Kind {
+	case KeyKindCertAuthority:
+		if len(ctx.Params.PermittedCertAuthorities) != 0 && !ctx.Params.IsCertAuthorityPermitted(k.Key) {
+			detail := "trusted to sign certificates for this account, but not in the permitted certificate authorities"
+			if principals := k.Options.Principals(); principals != nil {
+				detail += fmt.Sprintf(" (principals %s)", strings.Join(principals, ","))
+			}
+			problems = append(problems, PubKeyProblem{ProblemType: UnapprovedCertAuthority, ProblemKey: k, Detail: detail})
+		}
+	case KeyKindCertificate:
+		cert := k.Key.(*ssh.Certificate)
+		if expiry, ok := certExpiry(cert); ok && !ctx.now().Before(expiry) {
+			problems = append(problems, PubKeyProblem{ProblemType: CertificateExpired, ProblemKey: k,
+				Detail: fmt.Sprintf("certificate %q (serial %d) expired at %s", cert.KeyId, cert.Serial, expiry.Format(time.RFC3339))})
+		}
+	}
+	return problems
+}
+
+// IsCertAuthorityPermitted returns true if a CA key has one of the fingerprints in PermittedCertAuthorities.
+func (sp *ScanParams) IsCertAuthorityPermitted(k ssh.PublicKey) bool {
+	for _, fp := range sp.PermittedCertAuthorities {
+		if KeyMatchesFingerprint(k, fp) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package keyscan
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// A DuplicateCluster is a single key that turned up in more than one file, along with every place it was found.
+// One cluster is reported per distinct key, however many people share it.
+type DuplicateCluster struct {
+	ProblemType    PKProblemType   `json:"problem_type"`
+	Fingerprint    string          `json:"fingerprint"` // SHA256 fingerprint of the shared key
+	Key            KeyDescription  `json:"key"`         // The shared key itself
+	Owners         []string        `json:"owners"`      // Each distinct owner of a file the key was found in, in the order found
+	Files          []string        `json:"files"`       // Each distinct file the key was found in, in the order found
+	Occurrences    []KeyOccurrence `json:"occurrences"` // Each distinct owner, file and line the key was found at
+	DistinctOwners int             `json:"distinct_owners"`
+	DistinctFiles  int             `json:"distinct_files"`
+}
+
+// A KeyOccurrence is one place a key was found: the provenance half of an OwnedPubKey.
+type KeyOccurrence struct {
+	Owner      string     `json:"owner"`
+	OwnerID    int        `json:"owner_id"`
+	SourceFile string     `json:"source_file"`
+	SourceLine int        `json:"source_line"`
+	Comment    string     `json:"comment"`
+	Options    KeyOptions `json:"options"`
+}
+
+// NewDuplicateCluster builds a DuplicateCluster out of a set of OwnedPubKeys that all have the same key,
+//  e.g. the result of a KeyIndex lookup.
+// Repeated owner/file/line combinations are only listed once.
+func NewDuplicateCluster(opks []OwnedPubKey) DuplicateCluster {
+	c := DuplicateCluster{ProblemType: DuplicateKey, Owners: make([]string, 0), Files: make([]string, 0), Occurrences: make([]KeyOccurrence, 0)}
+	if len(opks) == 0 {
+		return c
+	}
+	c.Key = DescribeKey(opks[0].Key)
+	c.Fingerprint = opks[0].Fingerprint()
+
+	seenOwners := make(map[string]bool)
+	seenFiles := make(map[string]bool)
+	type occurrenceID struct {
+		owner string
+		file  string
+		line  int
+	}
+	seenOccurrences := make(map[occurrenceID]bool)
+	for _, k := range opks {
+		if !seenOwners[k.Owner] {
+			seenOwners[k.Owner] = true
+			c.Owners = append(c.Owners, k.Owner)
+		}
+		if !seenFiles[k.SourceFile] {
+			seenFiles[k.SourceFile] = true
+			c.Files = append(c.Files, k.SourceFile)
+		}
+		id := occurrenceID{owner: k.Owner, file: k.SourceFile, line: k.SourceLine}
+		if !seenOccurrences[id] {
+			seenOccurrences[id] = true
+			c.Occurrences = append(c.Occurrences, KeyOccurrence{Owner: k.Owner, OwnerID: k.OwnerID, SourceFile: k.SourceFile, SourceLine: k.SourceLine, Comment: k.Comment, Options: k.Options})
+		}
+	}
+	c.DistinctOwners = len(c.Owners)
+	c.DistinctFiles = len(c.Files)
+	return c
+}
+
+// FindDuplicateClusters groups the found keys by fingerprint and returns a cluster for every key found in more
+//  than one file, unless it's permitted for all its owners, forbidden (which is reported separately), every owner is ignored,
+//  or every owner is in the same sharing group.
+// cert-authority lines are left out: a site CA is meant to be in everyone's files, and CheckCertificates deals with them.
+func (ctx *ScanContext) FindDuplicateClusters() []DuplicateCluster {
+	clusters := make([]DuplicateCluster, 0)
+	for _, fp := range ctx.foundIndex.Fingerprints() {
+		opks := withoutCertAuthorities(ctx.foundIndex.LookupFingerprint(fp))
+		if len(opks) == 0 {
+			continue
+		}
+		cluster := NewDuplicateCluster(opks)
+		if cluster.DistinctFiles < 2 {
+			continue
+		}
+		if ctx.IsSharingPermitted(opks[0].Key, cluster.Owners) || ctx.IsKeyForbidden(opks[0]) {
+			continue
+		}
+		if ctx.allOwnersIgnored(cluster.Occurrences) {
+			continue
+		}
+		if group, ok := ctx.sharingGroupOf(cluster.Owners); ok {
+			log.WithFields(log.Fields{"fingerprint": fp, "group": group}).Debug("Key only shared within a sharing group")
+			continue
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
+
+// withoutCertAuthorities returns the keys that aren't on cert-authority lines.
+func withoutCertAuthorities(opks []OwnedPubKey) []OwnedPubKey {
+	keys := make([]OwnedPubKey, 0, len(opks))
+	for _, k := range opks {
+		if k.Kind != KeyKindCertAuthority {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// allOwnersIgnored returns true if the ScanContext's Params are set to ignore the owner of every one of the occurrences passed.
+func (ctx *ScanContext) allOwnersIgnored(occurrences []KeyOccurrence) bool {
+	for _, o := range occurrences {
+		if !ctx.ShouldIgnoreUser(o.Owner, o.OwnerID) {
+			return false
+		}
+	}
+	return true
+}
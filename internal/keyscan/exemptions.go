@@ -0,0 +1,211 @@
+package keyscan
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+// A SharingExemption permits one key to be shared, but only among the users and groups listed, and only
+//  until it expires. They're read from permitted key files ending in .yaml or .yml, which hold a list of them:
+//
+//  - fingerprint: SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU
+//    users: [alice, bob]
+//    groups: [project-x]
+//    expires: 2021-06-30
+//    justification: Shared deploy key for the project-x pipeline
+//    ticket: INC-1234
+//
+// A full public key can be given with key: instead of fingerprint:. With no users or groups, anyone may share the key,
+//  as with a key in a plain permitted key file.
+type SharingExemption struct {
+	Fingerprint   string   `json:"fingerprint" yaml:"fingerprint"` // In the form ParseFingerprint returns
+	Key           string   `json:"-" yaml:"key"`                   // Only used to work out Fingerprint
+	Users         []string `json:"users" yaml:"users"`
+	Groups        []string `json:"groups" yaml:"groups"`
+	Expires       string   `json:"expires,omitempty" yaml:"expires"` // YYYY-MM-DD, the last day the exemption applies
+	Justification string   `json:"justification,omitempty" yaml:"justification"`
+	Ticket        string   `json:"ticket,omitempty" yaml:"ticket"`
+	SourceFile    string   `json:"source_file" yaml:"-"`
+	SourceEntry   int      `json:"source_entry" yaml:"-"` // Which entry in the file, counting from 1
+
+	expiry time.Time // Midnight at the end of the Expires day, local time; zero if it never expires
+}
+
+// ExpiredExemptionProblem is a sharing exemption that has expired for a key that's still in use, so the key
+//  is no longer exempt: any sharing it allowed is reported as a duplicate again.
+type ExpiredExemptionProblem struct {
+	ProblemType PKProblemType    `json:"problem_type"`
+	Exemption   SharingExemption `json:"exemption"`
+	Owners      []string         `json:"owners"` // Everyone the key was found for
+}
+
+// isPermittedKeysYAML returns true if a permitted key file should be read as a list of SharingExemptions.
+func isPermittedKeysYAML(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// ReadSharingExemptions reads a YAML file of SharingExemptions.
+// Entries that can't be used, e.g. with an invalid fingerprint or date, are left out, with an error for each.
+func ReadSharingExemptions(filename string) ([]SharingExemption, []error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, []error{newFileScanError(filename, StageRead, err)}
+	}
+	var entries []SharingExemption
+	if err := yaml.UnmarshalStrict(contents, &entries); err != nil {
+		return nil, []error{&ScanError{Path: filename, Stage: StageParse, Err: err}}
+	}
+
+	exemptions := make([]SharingExemption, 0, len(entries))
+	errs := make([]error, 0)
+	for i, e := range entries {
+		e.SourceFile, e.SourceEntry = filename, i+1
+		if err := e.validate(); err != nil {
+			errs = append(errs, &ScanError{Path: filename, Stage: StageParse, Err: fmt.Errorf("entry %d: %v", i+1, err)})
+			continue
+		}
+		exemptions = append(exemptions, e)
+	}
+	return exemptions, errs
+}
+
+// validate checks an exemption read from a file, and fills in its fingerprint and expiry.
+func (e *SharingExemption) validate() error {
+	switch {
+	case e.Fingerprint != "" && e.Key != "":
+		return errors.New("give either fingerprint or key, not both")
+	case e.Fingerprint != "":
+		fp, ok := ParseFingerprint(e.Fingerprint)
+		if !ok {
+			return fmt.Errorf("invalid fingerprint %q", e.Fingerprint)
+		}
+		e.Fingerprint = fp
+	case e.Key != "":
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(e.Key))
+		if err != nil {
+			return fmt.Errorf("invalid key: %v", err)
+		}
+		e.Fingerprint, e.Key = KeyFingerprint(key), ""
+	default:
+		return errors.New("needs a fingerprint or key")
+	}
+
+	if e.Expires != "" {
+		day, err := time.ParseInLocation("2006-01-02", e.Expires, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid expiry date %q: should be YYYY-MM-DD", e.Expires)
+		}
+		e.expiry = day.AddDate(0, 0, 1)
+	}
+	if e.Users == nil {
+		e.Users = []string{}
+	}
+	if e.Groups == nil {
+		e.Groups = []string{}
+	}
+	return nil
+}
+
+// ExpiredAt returns true if the exemption no longer applies at t.
+func (e *SharingExemption) ExpiredAt(t time.Time) bool {
+	return !e.expiry.IsZero() && !t.Before(e.expiry)
+}
+
+// Unscoped returns true if the exemption lets anyone share the key.
+func (e *SharingExemption) Unscoped() bool {
+	return len(e.Users) == 0 && len(e.Groups) == 0
+}
+
+// exemptionCovers returns true if an exemption's scope includes a user, by name or by one of their groups.
+func (ctx *ScanContext) exemptionCovers(e *SharingExemption, user string) bool {
+	if e.Unscoped() || stringInStringSlice(user, e.Users) {
+		return true
+	}
+	return len(e.Groups) != 0 && anyInStringSlice(ctx.groupsOf(user), e.Groups)
+}
+
+// exemptionsFor returns every exemption for a key, expired or not.
+func (ctx *ScanContext) exemptionsFor(k ssh.PublicKey) []*SharingExemption {
+	matches := make([]*SharingExemption, 0)
+	if len(ctx.SharingExemptions) == 0 {
+		return matches
+	}
+	sha256fp, md5fp := KeyFingerprint(k), "MD5:"+ssh.FingerprintLegacyMD5(k)
+	for i := range ctx.SharingExemptions {
+		if fp := ctx.SharingExemptions[i].Fingerprint; fp == sha256fp || fp == md5fp {
+			matches = append(matches, &ctx.SharingExemptions[i])
+		}
+	}
+	return matches
+}
+
+// activeExemptionCovering returns an unexpired exemption for k's key whose scope includes every one of owners.
+func (ctx *ScanContext) activeExemptionCovering(k ssh.PublicKey, owners []string) (*SharingExemption, bool) {
+	now := ctx.now()
+	for _, e := range ctx.exemptionsFor(k) {
+		if e.ExpiredAt(now) {
+			continue
+		}
+		covered := true
+		for _, o := range owners {
+			if !ctx.exemptionCovers(e, o) {
+				covered = false
+				break
+			}
+		}
+		if covered {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// now is the time exemptions are checked against: when the scan started, or the current time if it wasn't started by Go.
+func (ctx *ScanContext) now() time.Time {
+	if ctx.StartTime.IsZero() {
+		return time.Now()
+	}
+	return ctx.StartTime
+}
+
+// GatherSharingExemptionsFromFile reads a YAML file of SharingExemptions into the context, recording any
+//  errors in it as scan errors.
+func (ctx *ScanContext) GatherSharingExemptionsFromFile(filename string) {
+	exemptions, errs := ReadSharingExemptions(filename)
+	for _, err := range errs {
+		ctx.recordScanErrors(asScanError(err, filename, StageParse))
+	}
+	log.WithFields(log.Fields{"file": filename, "exemptions": len(exemptions)}).Debug("Read sharing exemptions")
+	ctx.SharingExemptions = append(ctx.SharingExemptions, exemptions...)
+}
+
+// FindExpiredExemptions returns a problem for every expired exemption for a key that was found in the scan,
+//  unless every owner of the key is ignored.
+func (ctx *ScanContext) FindExpiredExemptions() []ExpiredExemptionProblem {
+	problems := make([]ExpiredExemptionProblem, 0)
+	now := ctx.now()
+	for _, e := range ctx.SharingExemptions {
+		if !e.ExpiredAt(now) {
+			continue
+		}
+		opks := ctx.FindKeysByFingerprint(e.Fingerprint)
+		if len(opks) == 0 {
+			continue
+		}
+		cluster := NewDuplicateCluster(opks)
+		if ctx.allOwnersIgnored(cluster.Occurrences) {
+			continue
+		}
+		problems = append(problems, ExpiredExemptionProblem{ProblemType: ExpiredExemption, Exemption: e, Owners: cluster.Owners})
+	}
+	return problems
+}
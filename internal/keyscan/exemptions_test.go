@@ -0,0 +1,183 @@
+package keyscan
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// writeTestExemptions writes a YAML exemptions file into a temporary directory and returns its path.
+func writeTestExemptions(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "keyscan-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "exemptions.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadSharingExemptions(t *testing.T) {
+	k := testKey(t, 1)
+	fp := KeyFingerprint(k)
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k)))
+	path := writeTestExemptions(t, `
+- fingerprint: `+fp+`
+  users: [alice, bob]
+  groups: [project-x]
+  expires: 2021-06-30
+  justification: Shared deploy key
+  ticket: INC-1234
+- key: `+authorizedKey+` deploy@example.org
+- fingerprint: `+fp+`
+  key: `+authorizedKey+`
+- users: [carol]
+- fingerprint: SHA256:not-a-fingerprint
+- key: ssh-ed25519 AAAA
+- fingerprint: `+fp+`
+  expires: 30/06/2021
+`)
+
+	exemptions, errs := ReadSharingExemptions(path)
+	want := []SharingExemption{
+		{Fingerprint: fp, Users: []string{"alice", "bob"}, Groups: []string{"project-x"}, Expires: "2021-06-30",
+			Justification: "Shared deploy key", Ticket: "INC-1234", SourceFile: path, SourceEntry: 1,
+			expiry: time.Date(2021, 7, 1, 0, 0, 0, 0, time.Local)},
+		{Fingerprint: fp, Users: []string{}, Groups: []string{}, SourceFile: path, SourceEntry: 2},
+	}
+	if !reflect.DeepEqual(exemptions, want) {
+		t.Errorf("exemptions = %+v, want %+v", exemptions, want)
+	}
+	wantErrs := []string{"entry 3: give either fingerprint or key", "entry 4: needs a fingerprint or key",
+		"entry 5: invalid fingerprint", "entry 6: invalid key", "entry 7: invalid expiry date"}
+	if len(errs) != len(wantErrs) {
+		t.Fatalf("got %d errors, want %d: %v", len(errs), len(wantErrs), errs)
+	}
+	for i, err := range errs {
+		if !strings.Contains(err.Error(), wantErrs[i]) {
+			t.Errorf("error %d = %q, want it to mention %q", i+1, err, wantErrs[i])
+		}
+	}
+
+	// Unknown fields are mistakes, e.g. a misspelt expires, rather than something to skip over.
+	if _, errs := ReadSharingExemptions(writeTestExemptions(t, "- fingerprint: "+fp+"\n  expiry: 2021-06-30\n")); len(errs) != 1 {
+		t.Errorf("reading an exemption with an unknown field gave errors %v, want one", errs)
+	}
+	if _, errs := ReadSharingExemptions(filepath.Join(filepath.Dir(path), "missing.yaml")); len(errs) != 1 {
+		t.Errorf("reading a missing file gave errors %v, want one", errs)
+	}
+}
+
+func TestSharingExemptionExpiredAt(t *testing.T) {
+	e := SharingExemption{Fingerprint: KeyFingerprint(testKey(t, 1)), Expires: "2021-06-30"}
+	if err := e.validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{time.Date(2021, 6, 29, 12, 0, 0, 0, time.Local), false},
+		{time.Date(2021, 6, 30, 0, 0, 0, 0, time.Local), false},
+		{time.Date(2021, 6, 30, 23, 59, 59, 0, time.Local), false},
+		{time.Date(2021, 7, 1, 0, 0, 0, 0, time.Local), true},
+		{time.Date(2022, 1, 1, 0, 0, 0, 0, time.Local), true},
+	}
+	for _, tt := range tests {
+		if got := e.ExpiredAt(tt.t); got != tt.want {
+			t.Errorf("ExpiredAt(%v) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+
+	never := SharingExemption{Fingerprint: e.Fingerprint}
+	if err := never.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if never.ExpiredAt(time.Date(2100, 1, 1, 0, 0, 0, 0, time.Local)) {
+		t.Error("an exemption with no expiry date expired")
+	}
+}
+
+func TestExemptionCovers(t *testing.T) {
+	ctx := &ScanContext{}
+	ctx.cacheGroups("alice", []string{"alice", "project-x"})
+	ctx.cacheGroups("bob", []string{"bob", "users"})
+	ctx.cacheGroups("carol", []string{"carol", "project-x"})
+	tests := []struct {
+		users, groups []string
+		user          string
+		want          bool
+	}{
+		{nil, nil, "bob", true},
+		{[]string{"bob"}, nil, "bob", true},
+		{[]string{"bob"}, nil, "alice", false},
+		{nil, []string{"project-x"}, "alice", true},
+		{nil, []string{"project-x"}, "bob", false},
+		{[]string{"bob"}, []string{"project-x"}, "bob", true},
+		{[]string{"bob"}, []string{"project-x"}, "carol", true},
+		{[]string{"alice"}, []string{"staff"}, "carol", false},
+	}
+	for _, tt := range tests {
+		e := &SharingExemption{Users: tt.users, Groups: tt.groups}
+		if got := ctx.exemptionCovers(e, tt.user); got != tt.want {
+			t.Errorf("exemption for users %v and groups %v covers %s: %v, want %v", tt.users, tt.groups, tt.user, got, tt.want)
+		}
+	}
+
+	// A key shared within a group is only exempt if the exemption covers everyone it's shared by.
+	k := testKey(t, 1)
+	ctx.SharingExemptions = []SharingExemption{{Fingerprint: KeyFingerprint(k), Users: []string{}, Groups: []string{"project-x"}}}
+	if _, ok := ctx.activeExemptionCovering(k, []string{"alice", "carol"}); !ok {
+		t.Error("key shared by alice and carol isn't exempt, but both are in project-x")
+	}
+	if _, ok := ctx.activeExemptionCovering(k, []string{"alice", "bob"}); ok {
+		t.Error("key shared by alice and bob is exempt, but bob isn't in project-x")
+	}
+}
+
+func TestFindExpiredExemptions(t *testing.T) {
+	inUse, ignoredOnly, unused := testKey(t, 1), testKey(t, 2), testKey(t, 3)
+	found := func(owner string, k ssh.PublicKey) OwnedPubKey {
+		return OwnedPubKey{Owner: owner, OwnerID: -1, Key: k, SourceFile: "/home/" + owner + "/.ssh/authorized_keys", SourceLine: 1, Options: ParseKeyOptions(nil)}
+	}
+	exemption := func(k ssh.PublicKey, expires string) SharingExemption {
+		e := SharingExemption{Fingerprint: KeyFingerprint(k), Expires: expires}
+		if err := e.validate(); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	ctx := &ScanContext{
+		Params:    ScanParams{IgnoredOwners: []string{"svc"}},
+		StartTime: time.Date(2021, 7, 1, 9, 0, 0, 0, time.Local),
+		FoundKeys: []OwnedPubKey{found("alice", inUse), found("bob", inUse), found("svc", ignoredOnly)},
+		SharingExemptions: []SharingExemption{
+			exemption(inUse, "2021-06-30"),
+			exemption(inUse, "2021-07-01"),
+			exemption(inUse, ""),
+			exemption(ignoredOnly, "2021-06-30"),
+			exemption(unused, "2021-06-30"),
+		},
+	}
+
+	problems := ctx.FindExpiredExemptions()
+	if len(problems) != 1 {
+		t.Fatalf("got %d expired exemption problems, want 1 for the key still in use: %+v", len(problems), problems)
+	}
+	p := problems[0]
+	if p.ProblemType != ExpiredExemption || p.Exemption.Expires != "2021-06-30" || p.Exemption.Fingerprint != KeyFingerprint(inUse) {
+		t.Errorf("problem = %+v, want the exemption for the key in use that expired on 2021-06-30", p)
+	}
+	if want := []string{"alice", "bob"}; !reflect.DeepEqual(p.Owners, want) {
+		t.Errorf("owners = %v, want %v", p.Owners, want)
+	}
+}
@@ -0,0 +1,129 @@
+package keyscan
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ParseFingerprint checks whether s looks like a key fingerprint, and if so returns it in the form
+//  ssh-keygen -l prints it: SHA256:<unpadded base64> or MD5:<colon-separated lowercase hex>.
+// A bare colon-separated MD5 fingerprint, as older versions of ssh-keygen printed, is accepted too.
+func ParseFingerprint(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if len(s) > 7 && strings.EqualFold(s[:7], "SHA256:") {
+		b64 := strings.TrimRight(s[7:], "=")
+		decoded, err := base64.RawStdEncoding.DecodeString(b64)
+		if err != nil || len(decoded) != 32 {
+			return "", false
+		}
+		return "SHA256:" + b64, true
+	}
+	if len(s) > 4 && strings.EqualFold(s[:4], "MD5:") {
+		s = s[4:]
+	}
+	s = strings.ToLower(s)
+	decoded, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+	if err != nil || len(decoded) != 16 || len(s) != 47 {
+		return "", false
+	}
+	return "MD5:" + s, true
+}
+
+// FingerprintFromKeyOrFingerprint takes either a fingerprint or a public key in authorized_keys format
+//  (with or without options and comment) and returns a fingerprint in the form ParseFingerprint does.
+func FingerprintFromKeyOrFingerprint(s string) (string, error) {
+	if fp, ok := ParseFingerprint(s); ok {
+		return fp, nil
+	}
+	keys, lineErrors := ParseKeysFromBytes([]byte(s))
+	if len(lineErrors) != 0 {
+		return "", lineErrors[0].Err
+	}
+	if len(keys) != 1 {
+		return "", errors.New("expected exactly one key or fingerprint")
+	}
+	return KeyFingerprint(keys[0].Key), nil
+}
+
+// KeyMatchesFingerprint returns true if k has the fingerprint fp, which should be in the form ParseFingerprint returns.
+func KeyMatchesFingerprint(k ssh.PublicKey, fp string) bool {
+	if strings.HasPrefix(fp, "MD5:") {
+		return "MD5:"+ssh.FingerprintLegacyMD5(k) == fp
+	}
+	return ssh.FingerprintSHA256(k) == fp
+}
+
+// FindKeysByFingerprint returns every found key with the fingerprint fp, which should be in the form ParseFingerprint returns.
+func (ctx *ScanContext) FindKeysByFingerprint(fp string) []OwnedPubKey {
+	if ctx.foundIndex == nil {
+		ctx.buildIndexes()
+	}
+	if !strings.HasPrefix(fp, "MD5:") {
+		return ctx.foundIndex.LookupFingerprint(fp)
+	}
+	// The index is only by SHA256, so MD5 has to check one key from each entry.
+	for _, sha256fp := range ctx.foundIndex.Fingerprints() {
+		opks := ctx.foundIndex.LookupFingerprint(sha256fp)
+		if KeyMatchesFingerprint(opks[0].Key, fp) {
+			return opks
+		}
+	}
+	return nil
+}
+
+// A FingerprintEntry is a line of a forbidden or permitted key file that gives a key's fingerprint rather than
+//  the whole key, e.g. one taken from an auth log during an incident.
+type FingerprintEntry struct {
+	Fingerprint string `json:"fingerprint"` // In the form ParseFingerprint returns, or as given in a WeakKeyBlacklist file
+	SourceFile  string `json:"source_file"`
+	SourceLine  int    `json:"source_line"`
+	Comment     string `json:"comment"` // Anything after the fingerprint on its line
+}
+
+// A FingerprintIndex finds the FingerprintEntries for a key by either of its fingerprints.
+type FingerprintIndex struct {
+	entries map[string][]FingerprintEntry
+	md5     bool // Whether any entries are MD5, so the MD5 fingerprint of keys being looked up is only worked out if needed
+}
+
+// NewFingerprintIndex returns a FingerprintIndex containing all of entries.
+func NewFingerprintIndex(entries []FingerprintEntry) *FingerprintIndex {
+	fi := &FingerprintIndex{entries: make(map[string][]FingerprintEntry, len(entries))}
+	for _, e := range entries {
+		fi.entries[e.Fingerprint] = append(fi.entries[e.Fingerprint], e)
+		if strings.HasPrefix(e.Fingerprint, "MD5:") {
+			fi.md5 = true
+		}
+	}
+	return fi
+}
+
+// Lookup returns every entry in the index with the SHA256 or MD5 fingerprint of k.
+func (fi *FingerprintIndex) Lookup(k ssh.PublicKey) []FingerprintEntry {
+	if len(fi.entries) == 0 {
+		return nil
+	}
+	matches := fi.entries[KeyFingerprint(k)]
+	if fi.md5 {
+		matches = append(append([]FingerprintEntry{}, matches...), fi.entries["MD5:"+ssh.FingerprintLegacyMD5(k)]...)
+	}
+	return matches
+}
+
+// Contains returns true if the index has an entry for k.
+func (fi *FingerprintIndex) Contains(k ssh.PublicKey) bool {
+	return len(fi.Lookup(k)) != 0
+}
+
+// Len returns the number of entries in the index.
+func (fi *FingerprintIndex) Len() int {
+	n := 0
+	for _, es := range fi.entries {
+		n += len(es)
+	}
+	return n
+}
@@ -0,0 +1,149 @@
+package keyscan
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// fromProbeAddresses are spread across the IPv4 and IPv6 address spaces: a from= wildcard pattern that matches all
+//  of either set, e.g. * or *.*.*.*, lets a key in from anywhere.
+var fromProbeAddresses = [][]string{
+	{"1.2.3.4", "100.64.10.20", "203.0.113.254", "255.255.255.255"},
+	{"::1", "2001:db8::7", "fe80::1:2:3:4", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+}
+
+// errNetworkHostBits is the error for a network like 10.0.0.1/8, which sshd rejects outright.
+var errNetworkHostBits = errors.New("has bits set beyond its mask")
+
+// A FromPattern is one entry in the comma-separated list of a from= option.
+// sshd tries each entry as an address or CIDR network first, and only if that fails, as a wildcard pattern
+//  for the connecting host's name or address.
+type FromPattern struct {
+	Text    string     // The entry, without any leading !
+	Negated bool       // Whether a match means the key can't be used, rather than that it can
+	Network *net.IPNet // The network, if the entry is an address or CIDR network
+}
+
+// ParseFromPatterns splits the value of a from= option into its patterns, the way sshd does.
+// An error is returned for any entry sshd would reject the whole key for, or that can never match.
+func ParseFromPatterns(list string) ([]FromPattern, []error) {
+	patterns := make([]FromPattern, 0)
+	errs := make([]error, 0)
+	for _, entry := range strings.Split(list, ",") {
+		p := FromPattern{Text: entry}
+		if strings.HasPrefix(p.Text, "!") {
+			p.Negated, p.Text = true, p.Text[1:]
+		}
+		switch {
+		case p.Text == "":
+			errs = append(errs, errors.New("has an empty pattern, so sshd rejects the key"))
+			continue
+		case strings.TrimSpace(p.Text) != p.Text:
+			errs = append(errs, fmt.Errorf("pattern %q has spaces around it, which sshd doesn't ignore, so it never matches", entry))
+			continue
+		}
+		network, err := ParseNetwork(p.Text)
+		switch {
+		case err == nil:
+			p.Network = network
+		case errors.Is(err, errNetworkHostBits):
+			errs = append(errs, fmt.Errorf("pattern %q %v, so sshd rejects the key", entry, errNetworkHostBits))
+			continue
+		case strings.Contains(p.Text, "/"):
+			// sshd would fall back to a wildcard match, but no hostname or address has a / in it.
+			errs = append(errs, fmt.Errorf("pattern %q is not a valid network, so it never matches", entry))
+			continue
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, errs
+}
+
+// ParseNetwork parses an address, or a CIDR network, e.g. 10.0.0.0/8, as a network.
+// Like sshd, it doesn't accept a network with bits set in the address beyond the mask, e.g. 10.0.0.1/8.
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an address", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}, nil
+	}
+	ip, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a valid network", s)
+	}
+	if !ip.Equal(network.IP) {
+		return nil, fmt.Errorf("%q %w", s, errNetworkHostBits)
+	}
+	return network, nil
+}
+
+// MatchesEverywhere returns true if a pattern lets a key in from any address, e.g. * or 0.0.0.0/0.
+func (p FromPattern) MatchesEverywhere() bool {
+	if p.Network != nil {
+		ones, _ := p.Network.Mask.Size()
+		return ones == 0
+	}
+	for _, probes := range fromProbeAddresses {
+		all := true
+		for _, addr := range probes {
+			all = all && matchPattern(addr, p.Text)
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+// networkWithin returns true if every address in inner is in outer.
+func networkWithin(inner, outer *net.IPNet) bool {
+	innerOnes, innerBits := inner.Mask.Size()
+	outerOnes, outerBits := outer.Mask.Size()
+	return innerBits == outerBits && innerOnes >= outerOnes && outer.Contains(inner.IP)
+}
+
+// CheckFromOption returns a problem for every pattern in a key's from= option that's invalid, lets the key in
+//  from anywhere, or is a network outside the allowed from networks, if any are set.
+// Hostname patterns can't be checked against the allowed networks, so they aren't; nor are negated patterns,
+//  which only narrow down where the key can be used from.
+func (ctx *ScanContext) CheckFromOption(k OwnedPubKey) []PubKeyProblem {
+	problems := make([]PubKeyProblem, 0)
+	list, ok := k.Options.Value("from")
+	if !ok {
+		return problems
+	}
+	patterns, errs := ParseFromPatterns(list)
+	for _, err := range errs {
+		problems = append(problems, PubKeyProblem{ProblemType: FromPatternInvalid, ProblemKey: k, Detail: "from= " + err.Error()})
+	}
+	for _, p := range patterns {
+		switch {
+		case p.Negated:
+		case p.MatchesEverywhere():
+			problems = append(problems, PubKeyProblem{ProblemType: FromPatternTooBroad, ProblemKey: k,
+				Detail: fmt.Sprintf("from= pattern %q matches any address", p.Text)})
+		case p.Network != nil && len(ctx.Params.AllowedFromNetworks) != 0 && !ctx.inAllowedFromNetworks(p.Network):
+			problems = append(problems, PubKeyProblem{ProblemType: FromPatternNotAllowed, ProblemKey: k,
+				Detail: fmt.Sprintf("from= pattern %q is not within the allowed networks", p.Text)})
+		}
+	}
+	return problems
+}
+
+// inAllowedFromNetworks returns true if a network is within one of the allowed from networks.
+// Those are checked before the scan starts, so any that don't parse are skipped.
+func (ctx *ScanContext) inAllowedFromNetworks(n *net.IPNet) bool {
+	for _, s := range ctx.Params.AllowedFromNetworks {
+		if allowed, err := ParseNetwork(s); err == nil && networkWithin(n, allowed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package keyscan
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFromPatterns(t *testing.T) {
+	tests := []struct {
+		list     string
+		patterns []string // Each pattern's Text, with a ! in front if it's negated and the network after if it has one
+		errs     int
+	}{
+		{"10.0.0.1", []string{"10.0.0.1 10.0.0.1/32"}, 0},
+		{"10.0.0.0/8", []string{"10.0.0.0/8 10.0.0.0/8"}, 0},
+		{"2001:db8::/32", []string{"2001:db8::/32 2001:db8::/32"}, 0},
+		{"2001:db8::1", []string{"2001:db8::1 2001:db8::1/128"}, 0},
+		{"!10.1.0.0/16,10.0.0.0/8", []string{"!10.1.0.0/16 10.1.0.0/16", "10.0.0.0/8 10.0.0.0/8"}, 0},
+		{"*.example.com,!bad.example.com", []string{"*.example.com", "!bad.example.com"}, 0},
+		{"10.0.0.*", []string{"10.0.0.*"}, 0},
+		{"host?.example.com", []string{"host?.example.com"}, 0},
+		{"*", []string{"*"}, 0},
+		{"", []string{}, 1},
+		{"10.0.0.1,", []string{"10.0.0.1 10.0.0.1/32"}, 1},
+		{"!", []string{}, 1},
+		{"10.0.0.1/8", []string{}, 1},
+		{"10.0.0.0/33", []string{}, 1},
+		{"example.com/24", []string{}, 1},
+		{" 10.0.0.1", []string{}, 1},
+		{"10.0.0.1 ,10.0.0.2", []string{"10.0.0.2 10.0.0.2/32"}, 1},
+		{"10.0.0.1/8,,*.example.com", []string{"*.example.com"}, 2},
+	}
+	for _, tt := range tests {
+		patterns, errs := ParseFromPatterns(tt.list)
+		got := make([]string, 0, len(patterns))
+		for _, p := range patterns {
+			s := p.Text
+			if p.Negated {
+				s = "!" + s
+			}
+			if p.Network != nil {
+				s += " " + p.Network.String()
+			}
+			got = append(got, s)
+		}
+		if !reflect.DeepEqual(got, tt.patterns) {
+			t.Errorf("ParseFromPatterns(%q) = %q, want %q", tt.list, got, tt.patterns)
+		}
+		if len(errs) != tt.errs {
+			t.Errorf("ParseFromPatterns(%q) gave %d errors, want %d: %v", tt.list, len(errs), tt.errs, errs)
+		}
+	}
+}
+
+func TestFromPatternMatchesEverywhere(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{"*", true},
+		{"*.*.*.*", true},
+		{"*:*", true},
+		{"0.0.0.0/0", true},
+		{"::/0", true},
+		{"10.0.0.0/8", false},
+		{"10.*", false},
+		{"*.example.com", false},
+		{"?.?.?.?", false},
+	}
+	for _, tt := range tests {
+		patterns, errs := ParseFromPatterns(tt.pattern)
+		if len(errs) != 0 || len(patterns) != 1 {
+			t.Errorf("ParseFromPatterns(%q) = %v, %v", tt.pattern, patterns, errs)
+			continue
+		}
+		if got := patterns[0].MatchesEverywhere(); got != tt.want {
+			t.Errorf("%q matches everywhere: %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestCheckFromOption(t *testing.T) {
+	ctx := &ScanContext{Params: ScanParams{AllowedFromNetworks: []string{"10.0.0.0/8", "2001:db8::/32", "not a network"}}}
+	tests := []struct {
+		option string
+		want   []PKProblemType
+	}{
+		{"", nil},
+		{`from="10.1.2.3"`, nil},
+		{`from="10.1.0.0/16,2001:db8:1::/48"`, nil},
+		{`from="*.example.com"`, nil},
+		{`from="!192.168.0.0/16,10.0.0.0/8"`, nil},
+		{`from="192.168.0.1"`, []PKProblemType{FromPatternNotAllowed}},
+		{`from="0.0.0.0/0"`, []PKProblemType{FromPatternTooBroad}},
+		{`from="10.0.0.0/8,*"`, []PKProblemType{FromPatternTooBroad}},
+		{`from="!*,10.0.0.1"`, nil},
+		{`from="10.0.0.1/8"`, []PKProblemType{FromPatternInvalid}},
+		{`from=""`, []PKProblemType{FromPatternInvalid}},
+		{`from="10.0.0.1,,192.168.0.1"`, []PKProblemType{FromPatternInvalid, FromPatternNotAllowed}},
+	}
+	for _, tt := range tests {
+		options := make([]string, 0)
+		if tt.option != "" {
+			options = append(options, tt.option)
+		}
+		k := OwnedPubKey{Key: testKey(t, 1), Options: ParseKeyOptions(options)}
+		got := make([]PKProblemType, 0)
+		for _, p := range ctx.CheckFromOption(k) {
+			got = append(got, p.ProblemType)
+		}
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("CheckFromOption(%s) = %v, want %v", tt.option, got, tt.want)
+		}
+	}
+
+	// Without allowed networks, any network will do.
+	ctx = &ScanContext{}
+	k := OwnedPubKey{Key: testKey(t, 1), Options: ParseKeyOptions([]string{`from="192.168.0.1"`})}
+	if problems := ctx.CheckFromOption(k); len(problems) != 0 {
+		t.Errorf("CheckFromOption with no allowed networks = %+v, want no problems", problems)
+	}
+}
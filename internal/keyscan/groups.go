@@ -0,0 +1,90 @@
+package keyscan
+
+// userGroups returns the names of the groups a user from the user source is in, from the user directory.
+// A user whose groups can't be looked up is recorded as a scan error, once, and treated as in no groups.
+func (ctx *ScanContext) userGroups(u PasswdEntry) []string {
+	if groups, ok := ctx.groupsByUser[u.Name]; ok {
+		return groups
+	}
+	groups, err := ctx.userDirectory().GroupNames(u)
+	if err != nil {
+		ctx.recordOwnerLookupError(u.Name, err)
+	}
+	ctx.cacheGroups(u.Name, groups)
+	return groups
+}
+
+// groupsOf is userGroups for when only the user's name is known, e.g. a key's owner.
+// Users from the user source are remembered by userGroups, so they don't need to be in the user directory too.
+func (ctx *ScanContext) groupsOf(name string) []string {
+	if groups, ok := ctx.groupsByUser[name]; ok {
+		return groups
+	}
+	groups, err := getGroupNamesForUser(ctx.userDirectory(), name)
+	if err != nil {
+		ctx.recordOwnerLookupError(name, err)
+	}
+	ctx.cacheGroups(name, groups)
+	return groups
+}
+
+func (ctx *ScanContext) cacheGroups(name string, groups []string) {
+	if ctx.groupsByUser == nil {
+		ctx.groupsByUser = make(map[string][]string)
+	}
+	ctx.groupsByUser[name] = groups
+}
+
+// excludedByGroup returns true if a user is in one of the ignored groups, or scanned groups are set and
+//  they're in none of them.
+// Groups are only looked up if either is set.
+func (ctx *ScanContext) excludedByGroup(name string) bool {
+	if len(ctx.Params.IgnoredGroups) == 0 && len(ctx.Params.ScannedGroups) == 0 {
+		return false
+	}
+	return ctx.groupsExclude(ctx.groupsOf(name))
+}
+
+func (ctx *ScanContext) groupsExclude(groups []string) bool {
+	if anyInStringSlice(groups, ctx.Params.IgnoredGroups) {
+		return true
+	}
+	return len(ctx.Params.ScannedGroups) != 0 && !anyInStringSlice(groups, ctx.Params.ScannedGroups)
+}
+
+// inScannedGroups returns true if a user from the user source should have their key files looked for:
+//  scanned groups aren't set, or they're in one of them.
+func (ctx *ScanContext) inScannedGroups(u PasswdEntry) bool {
+	return len(ctx.Params.ScannedGroups) == 0 || anyInStringSlice(ctx.userGroups(u), ctx.Params.ScannedGroups)
+}
+
+// sharingGroupOf returns a sharing group every one of owners is in, if there is one, so that a key shared
+//  only among members of e.g. a project's group isn't a problem.
+func (ctx *ScanContext) sharingGroupOf(owners []string) (string, bool) {
+	if len(owners) == 0 {
+		return "", false
+	}
+	for _, g := range ctx.Params.SharingGroups {
+		shared := true
+		for _, o := range owners {
+			if !stringInStringSlice(g, ctx.groupsOf(o)) {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			return g, true
+		}
+	}
+	return "", false
+}
+
+// Returns true if any element of a is also in b.
+func anyInStringSlice(a []string, b []string) bool {
+	for _, s := range a {
+		if stringInStringSlice(s, b) {
+			return true
+		}
+	}
+	return false
+}
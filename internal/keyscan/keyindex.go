@@ -0,0 +1,67 @@
+package keyscan
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+// A KeyIndex groups OwnedPubKeys by the SHA256 fingerprint of their key's wire format,
+//  so finding every occurrence of a key is a map lookup instead of a walk through every key
+//  we've got, re-marshalling both sides of every comparison.
+type KeyIndex struct {
+	keys  map[string][]OwnedPubKey
+	order []string // Fingerprints in the order they were first added, so iterating is deterministic
+}
+
+// NewKeyIndex returns a KeyIndex containing all the keys in opks.
+func NewKeyIndex(opks []OwnedPubKey) *KeyIndex {
+	ki := &KeyIndex{keys: make(map[string][]OwnedPubKey, len(opks)), order: make([]string, 0, len(opks))}
+	for _, k := range opks {
+		ki.Add(k)
+	}
+	return ki
+}
+
+// KeyFingerprint returns the SHA256 fingerprint of a public key, in the same format ssh-keygen -l uses.
+func KeyFingerprint(k ssh.PublicKey) string {
+	return ssh.FingerprintSHA256(k)
+}
+
+// Fingerprint returns the SHA256 fingerprint of the public key in an OwnedPubKey.
+func (a OwnedPubKey) Fingerprint() string {
+	return KeyFingerprint(a.Key)
+}
+
+// Add puts another OwnedPubKey into the index.
+func (ki *KeyIndex) Add(k OwnedPubKey) {
+	fp := k.Fingerprint()
+	if _, ok := ki.keys[fp]; !ok {
+		ki.order = append(ki.order, fp)
+	}
+	ki.keys[fp] = append(ki.keys[fp], k)
+}
+
+// Lookup returns every OwnedPubKey in the index with the same key as k.
+func (ki *KeyIndex) Lookup(k OwnedPubKey) []OwnedPubKey {
+	return ki.LookupFingerprint(k.Fingerprint())
+}
+
+// LookupFingerprint returns every OwnedPubKey in the index whose key has the SHA256 fingerprint fp.
+func (ki *KeyIndex) LookupFingerprint(fp string) []OwnedPubKey {
+	return ki.keys[fp]
+}
+
+// Contains returns true if k's key is in the index.
+func (ki *KeyIndex) Contains(k OwnedPubKey) bool {
+	_, ok := ki.keys[k.Fingerprint()]
+	return ok
+}
+
+// Fingerprints returns the fingerprint of every distinct key in the index, in the order they were first added.
+func (ki *KeyIndex) Fingerprints() []string {
+	return ki.order
+}
+
+// Len returns the number of distinct keys in the index.
+func (ki *KeyIndex) Len() int {
+	return len(ki.order)
+}
@@ -0,0 +1,65 @@
+package keyscan
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// benchmarkKeys makes n found keys, one per user, with every 50th key also put in the next user's file,
+//  so that there are duplicates to find, along with a few permitted and forbidden keys.
+// Keys are made from fixed seeds, so every run scans the same keys.
+func benchmarkKeys(b *testing.B, n int) (found, permitted, forbidden []OwnedPubKey) {
+	keys := make([]ssh.PublicKey, n)
+	seed := make([]byte, ed25519.SeedSize)
+	for i := range keys {
+		binary.BigEndian.PutUint64(seed, uint64(i))
+		k, err := ssh.NewPublicKey(ed25519.NewKeyFromSeed(seed).Public())
+		if err != nil {
+			b.Fatal(err)
+		}
+		keys[i] = k
+	}
+
+	found = make([]OwnedPubKey, 0, n+n/50)
+	for i, k := range keys {
+		owner := fmt.Sprintf("user%d", i)
+		found = append(found, OwnedPubKey{Owner: owner, OwnerID: 1000 + i, Account: owner, AccountID: 1000 + i,
+			FileOwner: owner, FileOwnerID: 1000 + i, Key: k, SourceFile: "/home/" + owner + "/.ssh/authorized_keys", SourceLine: 1})
+		if i%50 == 49 {
+			next := fmt.Sprintf("user%d", i+1)
+			found = append(found, OwnedPubKey{Owner: next, OwnerID: 1001 + i, Account: next, AccountID: 1001 + i,
+				FileOwner: next, FileOwnerID: 1001 + i, Key: k, SourceFile: "/home/" + next + "/.ssh/authorized_keys", SourceLine: 2})
+		}
+	}
+	for i := 0; i < n; i += 100 {
+		permitted = append(permitted, OwnedPubKey{Owner: "permitted", Key: keys[i]})
+		forbidden = append(forbidden, OwnedPubKey{Owner: "forbidden", Key: keys[i+1]})
+	}
+	return found, permitted, forbidden
+}
+
+// BenchmarkScanKeysForProblems shows how long a scan takes as the number of keys grows. With keys looked
+//  up by fingerprint, 40 times the keys should take about 40 times as long, not 1600.
+func BenchmarkScanKeysForProblems(b *testing.B) {
+	level := log.GetLevel()
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(level)
+
+	for _, n := range []int{1000, 10000, 40000} {
+		found, permitted, forbidden := benchmarkKeys(b, n)
+		b.Run(fmt.Sprintf("keys=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ctx := &ScanContext{FoundKeys: found, PermittedKeys: permitted, ForbiddenKeys: forbidden}
+				if !ctx.ScanKeysForProblems() {
+					b.Fatal("no problems found")
+				}
+			}
+		})
+	}
+}
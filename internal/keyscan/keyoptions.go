@@ -0,0 +1,196 @@
+package keyscan
+
+import (
+	"strings"
+)
+
+// A KeyOption is a single entry from the options field at the start of an authorized_keys line,
+//  e.g. `no-pty` or `command="rsync --server"`.
+// See the AUTHORIZED_KEYS FILE FORMAT section of sshd(8) for the full list.
+type KeyOption struct {
+	Name     string `json:"name"`      // The option name, lowercased, since sshd matches them case-insensitively
+	Value    string `json:"value"`     // The option's value with any surrounding quotes removed and \" unescaped
+	HasValue bool   `json:"has_value"` // Whether the option had a value at all (e.g. `restrict` doesn't, `from=""` does)
+}
+
+// KeyOptions is the full, ordered set of options given for one key.
+type KeyOptions []KeyOption
+
+// ParseKeyOptions takes the options slice returned by ssh.ParseAuthorizedKey and splits each
+//  entry into a name and (unquoted) value.
+func ParseKeyOptions(raw []string) KeyOptions {
+	opts := make(KeyOptions, 0, len(raw))
+	for _, r := range raw {
+		opts = append(opts, parseKeyOption(r))
+	}
+	return opts
+}
+
+func parseKeyOption(r string) KeyOption {
+	eq := strings.IndexByte(r, '=')
+	if eq == -1 {
+		return KeyOption{Name: strings.ToLower(r)}
+	}
+	return KeyOption{Name: strings.ToLower(r[:eq]), Value: unquoteOptionValue(r[eq+1:]), HasValue: true}
+}
+
+// unquoteOptionValue strips the double quotes around an option value and replaces \" with ",
+//  which is the only escape sshd recognises in an option value.
+func unquoteOptionValue(v string) string {
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = v[1 : len(v)-1]
+	}
+	return strings.Replace(v, `\"`, `"`, -1)
+}
+
+// Has returns true if an option with the given name is present.
+func (o KeyOptions) Has(name string) bool {
+	name = strings.ToLower(name)
+	for _, v := range o {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Values returns the values of every option with the given name, in the order they appear.
+// Options like permitopen and environment can be given more than once.
+func (o KeyOptions) Values(name string) []string {
+	name = strings.ToLower(name)
+	values := make([]string, 0)
+	for _, v := range o {
+		if v.Name == name {
+			values = append(values, v.Value)
+		}
+	}
+	return values
+}
+
+// Value returns the value of the first option with the given name, and whether it was found.
+// sshd uses the first instance of single-valued options like command.
+func (o KeyOptions) Value(name string) (string, bool) {
+	name = strings.ToLower(name)
+	for _, v := range o {
+		if v.Name == name {
+			return v.Value, true
+		}
+	}
+	return "", false
+}
+
+// Strings returns the options formatted as they would be in an authorized_keys file.
+func (o KeyOptions) Strings() []string {
+	s := make([]string, 0, len(o))
+	for _, v := range o {
+		if v.HasValue {
+			s = append(s, v.Name+`="`+strings.Replace(v.Value, `"`, `\"`, -1)+`"`)
+		} else {
+			s = append(s, v.Name)
+		}
+	}
+	return s
+}
+
+// Command returns the forced command for the key, if there is one.
+func (o KeyOptions) Command() (string, bool) {
+	return o.Value("command")
+}
+
+// From returns the list of host/address patterns the key is restricted to, or nil if it
+//  has no from= option.
+func (o KeyOptions) From() []string {
+	v, ok := o.Value("from")
+	if !ok {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+// PermitOpen returns every host:port the key may open forwards to with permitopen=.
+func (o KeyOptions) PermitOpen() []string {
+	return o.Values("permitopen")
+}
+
+// PermitListen returns every [host:]port the key may listen on with permitlisten=.
+func (o KeyOptions) PermitListen() []string {
+	return o.Values("permitlisten")
+}
+
+// Environment returns every NAME=value pair set with environment=.
+func (o KeyOptions) Environment() []string {
+	return o.Values("environment")
+}
+
+// Principals returns the principals accepted for a cert-authority key, or nil if there is no principals= option.
+func (o KeyOptions) Principals() []string {
+	v, ok := o.Value("principals")
+	if !ok {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+// Restrict returns true if the key has the restrict option, which disables everything not explicitly re-enabled.
+func (o KeyOptions) Restrict() bool {
+	return o.Has("restrict")
+}
+
+// CertAuthority returns true if the key is marked as a trusted certificate authority.
+func (o KeyOptions) CertAuthority() bool {
+	return o.Has("cert-authority")
+}
+
+// ExpiryTime returns the raw expiry-time= value, if there is one.
+func (o KeyOptions) ExpiryTime() (string, bool) {
+	return o.Value("expiry-time")
+}
+
+// AllowsPty returns false if pty allocation is disabled by no-pty, or by restrict without a later pty.
+func (o KeyOptions) AllowsPty() bool {
+	return o.allows("pty")
+}
+
+// AllowsPortForwarding returns false if port forwarding is disabled by no-port-forwarding or restrict.
+func (o KeyOptions) AllowsPortForwarding() bool {
+	return o.allows("port-forwarding")
+}
+
+// AllowsAgentForwarding returns false if agent forwarding is disabled by no-agent-forwarding or restrict.
+func (o KeyOptions) AllowsAgentForwarding() bool {
+	return o.allows("agent-forwarding")
+}
+
+// AllowsX11Forwarding returns false if X11 forwarding is disabled by no-x11-forwarding or restrict.
+func (o KeyOptions) AllowsX11Forwarding() bool {
+	return o.allows("x11-forwarding")
+}
+
+// AllowsUserRC returns false if ~/.ssh/rc execution is disabled by no-user-rc or restrict.
+func (o KeyOptions) AllowsUserRC() bool {
+	return o.allows("user-rc")
+}
+
+// IsUnrestricted returns true if the key has no options limiting where it can be used from or what it can do.
+func (o KeyOptions) IsUnrestricted() bool {
+	if o.Restrict() || o.Has("from") || o.Has("command") {
+		return false
+	}
+	return o.AllowsPty() && o.AllowsPortForwarding() && o.AllowsAgentForwarding() && o.AllowsX11Forwarding() && o.AllowsUserRC()
+}
+
+// allows works out whether a capability that can be turned off with no-<capability> or restrict,
+//  and back on again with <capability>, ends up enabled.
+// sshd processes options in order, so the last relevant one wins.
+func (o KeyOptions) allows(capability string) bool {
+	allowed := true
+	for _, v := range o {
+		switch v.Name {
+		case "restrict", "no-" + capability:
+			allowed = false
+		case capability:
+			allowed = true
+		}
+	}
+	return allowed
+}
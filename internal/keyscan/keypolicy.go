@@ -0,0 +1,66 @@
+package keyscan
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyPolicy sets out which algorithms and sizes of key are acceptable.
+// It's embedded in ScanParams, so its settings sit alongside the rest in the config file and report.
+type KeyPolicy struct {
+	AllowedKeyTypes    []string `json:"allowed_key_types"`    // If not empty, any key type not listed is a problem. (e.g. ssh-ed25519, ssh-rsa)
+	ForbidDSAKeys      bool     `json:"forbid_dsa_keys"`      // Flag all ssh-dss keys as deprecated.
+	MinRSABits         int      `json:"min_rsa_bits"`         // Flag RSA keys with a modulus smaller than this. 0 turns the check off.
+	AllowedECDSACurves []string `json:"allowed_ecdsa_curves"` // If not empty, ECDSA keys on any curve not listed are a problem. (e.g. nistp256)
+}
+
+// CheckKey returns a problem for every way k falls short of the policy.
+// Certificates are judged by the key they certify.
+func (kp *KeyPolicy) CheckKey(k OwnedPubKey) []PubKeyProblem {
+	problems := make([]PubKeyProblem, 0)
+	key := k.Key
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	keyType := key.Type()
+
+	if len(kp.AllowedKeyTypes) != 0 && !stringInStringSlice(keyType, kp.AllowedKeyTypes) {
+		problems = append(problems, PubKeyProblem{ProblemType: KeyTypeNotAllowed, ProblemKey: k,
+			Detail: fmt.Sprintf("key type %s is not in the allowed list", keyType)})
+	}
+
+	if kp.ForbidDSAKeys && keyType == ssh.KeyAlgoDSA {
+		problems = append(problems, PubKeyProblem{ProblemType: KeyTypeDeprecated, ProblemKey: k,
+			Detail: "DSA keys are deprecated and disabled by default since OpenSSH 7.0"})
+	}
+
+	if kp.MinRSABits > 0 && keyType == ssh.KeyAlgoRSA {
+		if bits := KeyBits(key); bits < kp.MinRSABits {
+			problems = append(problems, PubKeyProblem{ProblemType: KeyTooSmall, ProblemKey: k,
+				Detail: fmt.Sprintf("RSA modulus is %d bits, the minimum is %d", bits, kp.MinRSABits)})
+		}
+	}
+
+	if curve := ecdsaCurveName(keyType); curve != "" && len(kp.AllowedECDSACurves) != 0 {
+		if !stringInStringSlice(curve, kp.AllowedECDSACurves) {
+			problems = append(problems, PubKeyProblem{ProblemType: ECDSACurveNotAllowed, ProblemKey: k,
+				Detail: fmt.Sprintf("ECDSA curve %s is not in the allowed list", curve)})
+		}
+	}
+
+	return problems
+}
+
+// ecdsaCurveName returns the curve name part of an ECDSA key type (e.g. nistp256 for ecdsa-sha2-nistp256),
+//  or "" if it isn't an ECDSA key type.
+func ecdsaCurveName(keyType string) string {
+	keyType = strings.TrimSuffix(keyType, "@openssh.com")
+	for _, prefix := range []string{"ecdsa-sha2-", "sk-ecdsa-sha2-"} {
+		if strings.HasPrefix(keyType, prefix) {
+			return strings.TrimPrefix(keyType, prefix)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,339 @@
+package keyscan
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A KRL is an OpenSSH Key Revocation List, as made by ssh-keygen -k and read by sshd from RevokedKeys.
+// The format is described in PROTOCOL.krl in the OpenSSH source.
+type KRL struct {
+	Version       uint64
+	GeneratedDate time.Time
+	Comment       string
+	SourceFile    string
+
+	keys   map[string]bool // The wire format of each explicitly revoked key
+	sha1   map[string]bool // Raw SHA1 hashes of the wire format of revoked keys
+	sha256 map[string]bool // Raw SHA256 hashes, likewise
+	certs  []krlCertSection
+}
+
+// A krlCertSection revokes certificates signed by one CA, or by any CA if ca is nil, by serial or key ID.
+type krlCertSection struct {
+	ca      []byte // The wire format of the CA's key
+	serials []krlSerialRange
+	bitmaps []krlSerialBitmap
+	keyIDs  map[string]bool
+}
+
+type krlSerialRange struct {
+	min, max uint64
+}
+
+// A krlSerialBitmap revokes serial offset+i for every bit i set in bits.
+type krlSerialBitmap struct {
+	offset uint64
+	bits   *big.Int
+}
+
+const krlMagic = "SSHKRL\n\x00"
+
+const (
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlSectionCertSerialList   = 0x20
+	krlSectionCertSerialRange  = 0x21
+	krlSectionCertSerialBitmap = 0x22
+	krlSectionCertKeyID        = 0x23
+)
+
+// IsKRL returns true if data starts like a KRL, rather than e.g. a list of keys, which sshd also accepts as RevokedKeys.
+func IsKRL(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(krlMagic))
+}
+
+// isKRLFile returns true if a file starts like a KRL. If it can't be read, that's left for whatever reads it next to report.
+func isKRLFile(filename string) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	start := make([]byte, len(krlMagic))
+	if _, err := io.ReadFull(f, start); err != nil {
+		return false
+	}
+	return IsKRL(start)
+}
+
+// ReadKRL reads a KRL from a file.
+// Any error returned is a *ScanError saying which stage failed.
+func ReadKRL(filename string) (*KRL, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, newFileScanError(filename, StageRead, err)
+	}
+	krl, err := ParseKRL(data)
+	if err != nil {
+		return nil, &ScanError{Path: filename, Stage: StageParse, Err: err}
+	}
+	krl.SourceFile = filename
+	return krl, nil
+}
+
+// ParseKRL parses a binary KRL.
+// Signature sections are skipped, as modern sshd does, since nothing checks them.
+func ParseKRL(data []byte) (*KRL, error) {
+	if !IsKRL(data) {
+		return nil, errors.New("not a KRL: bad magic number")
+	}
+	r := &krlReader{b: data[len(krlMagic):]}
+	if v := r.readUint32(); r.err == nil && v != 1 {
+		return nil, fmt.Errorf("unsupported KRL format version %d", v)
+	}
+	krl := &KRL{keys: make(map[string]bool), sha1: make(map[string]bool), sha256: make(map[string]bool)}
+	krl.Version = r.readUint64()
+	if generated := r.readUint64(); generated != 0 {
+		krl.GeneratedDate = time.Unix(int64(generated), 0)
+	}
+	r.readUint64() // Flags, of which none are defined
+	r.readString() // Reserved
+	krl.Comment = string(r.readString())
+	if r.err != nil {
+		return nil, fmt.Errorf("KRL header: %v", r.err)
+	}
+
+	for len(r.b) != 0 && r.err == nil {
+		sectionType := r.readByte()
+		section := r.readString()
+		if r.err != nil {
+			break
+		}
+		var err error
+		switch sectionType {
+		case krlSectionCertificates:
+			err = krl.parseCertSection(section)
+		case krlSectionExplicitKey:
+			err = parseKRLBlobs(section, krl.keys)
+		case krlSectionFingerprintSHA1:
+			err = parseKRLBlobs(section, krl.sha1)
+		case krlSectionFingerprintSHA256:
+			err = parseKRLBlobs(section, krl.sha256)
+		case krlSectionSignature:
+			r.readString() // The section was the signing key; this is the signature
+		default:
+			err = fmt.Errorf("unsupported section type %d", sectionType)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("KRL section type %d: %v", sectionType, err)
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("KRL sections: %v", r.err)
+	}
+	return krl, nil
+}
+
+// parseKRLBlobs adds every string in a section to set.
+func parseKRLBlobs(section []byte, set map[string]bool) error {
+	r := &krlReader{b: section}
+	for len(r.b) != 0 && r.err == nil {
+		set[string(r.readString())] = true
+	}
+	return r.err
+}
+
+func (krl *KRL) parseCertSection(section []byte) error {
+	r := &krlReader{b: section}
+	cs := krlCertSection{ca: r.readString(), keyIDs: make(map[string]bool)}
+	r.readString() // Reserved
+	if len(cs.ca) == 0 {
+		cs.ca = nil
+	} else if _, err := ssh.ParsePublicKey(cs.ca); err != nil {
+		return fmt.Errorf("CA key: %v", err)
+	}
+
+	for len(r.b) != 0 && r.err == nil {
+		subType := r.readByte()
+		sub := &krlReader{b: r.readString()}
+		if r.err != nil {
+			break
+		}
+		switch subType {
+		case krlSectionCertSerialList:
+			for len(sub.b) != 0 && sub.err == nil {
+				s := sub.readUint64()
+				cs.serials = append(cs.serials, krlSerialRange{s, s})
+			}
+		case krlSectionCertSerialRange:
+			rng := krlSerialRange{sub.readUint64(), sub.readUint64()}
+			if sub.err == nil && rng.max < rng.min {
+				return fmt.Errorf("serial range %d-%d is backwards", rng.min, rng.max)
+			}
+			cs.serials = append(cs.serials, rng)
+		case krlSectionCertSerialBitmap:
+			bm := krlSerialBitmap{offset: sub.readUint64()}
+			bm.bits = new(big.Int).SetBytes(sub.readString())
+			cs.bitmaps = append(cs.bitmaps, bm)
+		case krlSectionCertKeyID:
+			for len(sub.b) != 0 && sub.err == nil {
+				cs.keyIDs[string(sub.readString())] = true
+			}
+		default:
+			return fmt.Errorf("unsupported certificate section type %#x", subType)
+		}
+		if sub.err != nil {
+			return fmt.Errorf("certificate section type %#x: %v", subType, sub.err)
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	krl.certs = append(krl.certs, cs)
+	return nil
+}
+
+// Revokes returns true and how, if the KRL revokes k, in the same way sshd checks: by the key itself, or its hashes,
+//  and for a certificate, by the certified key, by serial or key ID for its CA, or by the CA's key being revoked.
+func (krl *KRL) Revokes(k ssh.PublicKey) (string, bool) {
+	cert, isCert := k.(*ssh.Certificate)
+	if isCert {
+		k = cert.Key
+	}
+	if how, ok := krl.revokesKey(k); ok {
+		return how, true
+	}
+	if !isCert {
+		return "", false
+	}
+	if how, ok := krl.revokesCert(cert); ok {
+		return how, true
+	}
+	if how, ok := krl.revokesKey(cert.SignatureKey); ok {
+		return "CA key " + how, true
+	}
+	return "", false
+}
+
+func (krl *KRL) revokesKey(k ssh.PublicKey) (string, bool) {
+	blob := k.Marshal()
+	if len(krl.sha1) != 0 {
+		if h := sha1.Sum(blob); krl.sha1[string(h[:])] {
+			return "revoked by SHA1 hash", true
+		}
+	}
+	if len(krl.sha256) != 0 {
+		if h := sha256.Sum256(blob); krl.sha256[string(h[:])] {
+			return "revoked by SHA256 hash", true
+		}
+	}
+	if krl.keys[string(blob)] {
+		return "explicitly revoked", true
+	}
+	return "", false
+}
+
+func (krl *KRL) revokesCert(cert *ssh.Certificate) (string, bool) {
+	ca := cert.SignatureKey.Marshal()
+	for _, cs := range krl.certs {
+		if cs.ca != nil && !bytes.Equal(cs.ca, ca) {
+			continue
+		}
+		if cs.keyIDs[cert.KeyId] {
+			return fmt.Sprintf("certificate key ID %q revoked", cert.KeyId), true
+		}
+		// Serial 0 means the CA didn't give the certificate one, so it can't be revoked by serial.
+		if cert.Serial != 0 && cs.revokesSerial(cert.Serial) {
+			return fmt.Sprintf("certificate serial %d revoked", cert.Serial), true
+		}
+	}
+	return "", false
+}
+
+func (cs *krlCertSection) revokesSerial(serial uint64) bool {
+	for _, r := range cs.serials {
+		if serial >= r.min && serial <= r.max {
+			return true
+		}
+	}
+	for _, bm := range cs.bitmaps {
+		if serial >= bm.offset && serial-bm.offset < uint64(bm.bits.BitLen()) && bm.bits.Bit(int(serial-bm.offset)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of keys, hashes, certificate serial ranges and key IDs the KRL revokes.
+func (krl *KRL) Len() int {
+	n := len(krl.keys) + len(krl.sha1) + len(krl.sha256)
+	for _, cs := range krl.certs {
+		n += len(cs.serials) + len(cs.bitmaps) + len(cs.keyIDs)
+	}
+	return n
+}
+
+// krlReader reads the SSH wire format types KRLs are made of. After the first error, everything reads as zero.
+type krlReader struct {
+	b   []byte
+	err error
+}
+
+func (r *krlReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = errors.New("unexpected end of data")
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *krlReader) readByte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *krlReader) readUint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *krlReader) readUint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *krlReader) readString() []byte {
+	n := r.readUint32()
+	if r.err == nil && uint64(n) > uint64(len(r.b)) {
+		r.err = fmt.Errorf("string of length %d runs past the end of the data", n)
+		return nil
+	}
+	return r.next(int(n))
+}
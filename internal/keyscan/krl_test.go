@@ -0,0 +1,202 @@
+package keyscan
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The KRLs in testdata/krl are made by ssh-keygen -k, with gen.sh, one for each kind of section.
+var krlTests = []struct {
+	krl     string // The KRL file
+	revoked string // The key or certificate it revokes
+	how     string
+}{
+	{"serial-list.krl", "serial-5-cert.pub", "certificate serial 5 revoked"},
+	{"serial-range.krl", "serial-1050-cert.pub", "certificate serial 1050 revoked"},
+	{"serial-bitmap.krl", "serial-13-cert.pub", "certificate serial 13 revoked"},
+	{"key-id.krl", "key-id-cert.pub", `certificate key ID "revoked-id" revoked`},
+	{"explicit-key.krl", "revoked-key.pub", "explicitly revoked"},
+	{"sha1.krl", "sha1-key.pub", "revoked by SHA1 hash"},
+	{"sha256.krl", "sha256-key.pub", "revoked by SHA256 hash"},
+}
+
+func readTestKRLFile(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "krl", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func readTestKRLKey(t *testing.T, name string) ssh.PublicKey {
+	k, _, _, _, err := ssh.ParseAuthorizedKey(readTestKRLFile(t, name))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return k
+}
+
+func TestParseKRL(t *testing.T) {
+	for _, tt := range krlTests {
+		if !isKRLFile(filepath.Join("testdata", "krl", tt.krl)) {
+			t.Errorf("%s isn't recognised as a KRL", tt.krl)
+		}
+		krl, err := ParseKRL(readTestKRLFile(t, tt.krl))
+		if err != nil {
+			t.Errorf("%s: %v", tt.krl, err)
+			continue
+		}
+		if krl.Len() != 1 {
+			t.Errorf("%s: Len() = %d, want 1", tt.krl, krl.Len())
+		}
+
+		how, ok := krl.Revokes(readTestKRLKey(t, tt.revoked))
+		if !ok || how != tt.how {
+			t.Errorf("%s: Revokes(%s) = %q, %v, want %q", tt.krl, tt.revoked, how, ok, tt.how)
+		}
+		// Nothing else is revoked: not the keys and certificates the other KRLs revoke, nor a key and
+		//  certificate none of them do.
+		notRevoked := []string{"other-key.pub", "other-key-cert.pub"}
+		for _, other := range krlTests {
+			if other.revoked != tt.revoked {
+				notRevoked = append(notRevoked, other.revoked)
+			}
+		}
+		for _, name := range notRevoked {
+			if how, ok := krl.Revokes(readTestKRLKey(t, name)); ok {
+				t.Errorf("%s: Revokes(%s) = %q, want it not revoked", tt.krl, name, how)
+			}
+		}
+	}
+}
+
+func TestParseKRLNotKRL(t *testing.T) {
+	if isKRLFile(filepath.Join("testdata", "krl", "other-key.pub")) {
+		t.Error("a public key file was recognised as a KRL")
+	}
+	if _, err := ParseKRL(readTestKRLFile(t, "other-key.pub")); err == nil {
+		t.Error("ParseKRL of a public key file succeeded")
+	}
+}
+
+// krlSectionEnds returns the offset of the end of a KRL's header, and of each of its sections.
+// A KRL cut off at any of those is still valid, just with fewer sections.
+func krlSectionEnds(t *testing.T, data []byte) map[int]bool {
+	skipString := func(i int) int {
+		return i + 4 + int(binary.BigEndian.Uint32(data[i:]))
+	}
+	i := len(krlMagic) + 4 + 8 + 8 + 8 // Magic, format version, KRL version, generated date and flags
+	i = skipString(skipString(i))      // Reserved and comment
+	ends := map[int]bool{i: true}
+	for i < len(data) {
+		i = skipString(i + 1)
+		ends[i] = true
+	}
+	if i != len(data) {
+		t.Fatalf("sections run to %d, past the end of the KRL at %d", i, len(data))
+	}
+	return ends
+}
+
+func TestParseKRLTruncated(t *testing.T) {
+	for _, tt := range krlTests {
+		data := readTestKRLFile(t, tt.krl)
+		ends := krlSectionEnds(t, data)
+		for n := 0; n < len(data); n++ {
+			_, err := ParseKRL(data[:n])
+			if ends[n] && err != nil {
+				t.Errorf("%s cut off after a section, at %d bytes: %v", tt.krl, n, err)
+			}
+			if !ends[n] && err == nil {
+				t.Errorf("%s cut off at %d of %d bytes parsed without an error", tt.krl, n, len(data))
+			}
+		}
+	}
+}
+
+func TestParseKRLCorruptBytes(t *testing.T) {
+	// Whatever happens to each byte, parsing mustn't panic; most changes are errors, but some are just different KRLs.
+	for _, tt := range krlTests {
+		data := readTestKRLFile(t, tt.krl)
+		for i := range data {
+			for _, b := range []byte{0x00, 0x01, 0x7f, 0x80, 0xff, data[i] ^ 0x01} {
+				corrupt := append([]byte(nil), data...)
+				corrupt[i] = b
+				ParseKRL(corrupt)
+			}
+		}
+	}
+}
+
+// testKRL builds a KRL with the given sections, each a type followed by its contents.
+func testKRL(version uint32, sections ...[]byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(krlMagic)
+	binary.Write(&b, binary.BigEndian, version)
+	b.Write(make([]byte, 8+8+8)) // KRL version, generated date and flags
+	b.Write(testKRLString(nil))  // Reserved
+	b.Write(testKRLString([]byte("comment")))
+	for _, s := range sections {
+		b.WriteByte(s[0])
+		b.Write(testKRLString(s[1:]))
+	}
+	return b.Bytes()
+}
+
+func testKRLString(s []byte) []byte {
+	b := make([]byte, 4, 4+len(s))
+	binary.BigEndian.PutUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// testKRLCertSection builds a certificates section for any CA, with the given subsections.
+func testKRLCertSection(subsections ...[]byte) []byte {
+	b := []byte{krlSectionCertificates}
+	b = append(b, testKRLString(nil)...) // Any CA
+	b = append(b, testKRLString(nil)...) // Reserved
+	for _, s := range subsections {
+		b = append(b, s[0])
+		b = append(b, testKRLString(s[1:])...)
+	}
+	return b
+}
+
+func TestParseKRLInvalid(t *testing.T) {
+	serialRange := func(min, max uint64) []byte {
+		b := make([]byte, 17)
+		b[0] = krlSectionCertSerialRange
+		binary.BigEndian.PutUint64(b[1:], min)
+		binary.BigEndian.PutUint64(b[9:], max)
+		return b
+	}
+	hugeString := append([]byte{krlSectionExplicitKey}, 0xff, 0xff, 0xff, 0xff)
+
+	if krl, err := ParseKRL(testKRL(1, testKRLCertSection(serialRange(10, 20)))); err != nil || krl.Comment != "comment" || krl.Len() != 1 {
+		t.Fatalf("valid KRL built for the test: %+v, %v", krl, err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"bad magic", append([]byte("SSHKRL\n\x01"), testKRL(1)[len(krlMagic):]...)},
+		{"unsupported format version", testKRL(2)},
+		{"unsupported section type", testKRL(1, []byte{9, 'x'})},
+		{"unsupported certificate section type", testKRL(1, testKRLCertSection([]byte{0x30, 'x'}))},
+		{"backwards serial range", testKRL(1, testKRLCertSection(serialRange(20, 10)))},
+		{"short serial range", testKRL(1, testKRLCertSection(serialRange(10, 20)[:12]))},
+		{"invalid CA key", testKRL(1, append([]byte{krlSectionCertificates}, testKRLString([]byte("not a key"))...))},
+		{"section longer than the KRL", append(testKRL(1), hugeString...)},
+		{"key longer than its section", testKRL(1, hugeString)},
+	}
+	for _, tt := range tests {
+		if krl, err := ParseKRL(tt.data); err == nil {
+			t.Errorf("%s: ParseKRL succeeded, with %d entries", tt.name, krl.Len())
+		}
+	}
+}
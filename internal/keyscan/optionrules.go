@@ -0,0 +1,193 @@
+package keyscan
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// knownKeyOptions are the options sshd accepts in authorized_keys files, so that a typo in an option rule is
+//  caught rather than quietly never matching.
+var knownKeyOptions = []string{"agent-forwarding", "cert-authority", "command", "environment", "expiry-time", "from",
+	"no-agent-forwarding", "no-port-forwarding", "no-pty", "no-touch-required", "no-user-rc", "no-x11-forwarding",
+	"permitlisten", "permitopen", "port-forwarding", "principals", "pty", "restrict", "tunnel", "user-rc",
+	"verify-required", "x11-forwarding"}
+
+// An OptionRule sets out which authorized_keys options the keys of some users must or mustn't have, e.g.
+//
+//  - groups: [service-accounts]
+//    uids: "60000-65000"
+//    require: [from, restrict]
+//  - forbid: [environment, 'permitopen="*:*"']
+//  - require_when_shared: [command]
+//
+// Each option is given by name, which matches it with any value, or as name=value, which only matches that value.
+// A rule applies to the owners of keys in any of its users, groups or UIDs, or to everyone if none are given.
+// Every rule that applies to a key is checked.
+type OptionRule struct {
+	Users             []string `json:"users"`
+	Groups            []string `json:"groups"`
+	UIDs              string   `json:"uids,omitempty"`
+	Require           []string `json:"require"`             // Options the keys must have
+	Forbid            []string `json:"forbid"`              // Options the keys mustn't have
+	RequireWhenShared []string `json:"require_when_shared"` // Options the keys must have if they're reported as duplicates
+
+	uidRange          *UIDRange
+	require           KeyOptions
+	forbid            KeyOptions
+	requireWhenShared KeyOptions
+}
+
+// ParseOptionRule makes an OptionRule from the config's form of one, checking every option it names.
+func ParseOptionRule(users, groups []string, uids string, require, forbid, requireWhenShared []string) (OptionRule, error) {
+	r := OptionRule{Users: users, Groups: groups, UIDs: uids, Require: require, Forbid: forbid, RequireWhenShared: requireWhenShared}
+	if r.Users == nil {
+		r.Users = []string{}
+	}
+	if r.Groups == nil {
+		r.Groups = []string{}
+	}
+	if r.UIDs != "" {
+		min, max, err := parseUIDSpan(r.UIDs)
+		if err != nil {
+			return r, err
+		}
+		r.uidRange = &UIDRange{Min: min, Max: max}
+	}
+
+	var err error
+	if r.require, err = parseOptionPatterns(&r.Require); err != nil {
+		return r, err
+	}
+	if r.forbid, err = parseOptionPatterns(&r.Forbid); err != nil {
+		return r, err
+	}
+	if r.requireWhenShared, err = parseOptionPatterns(&r.RequireWhenShared); err != nil {
+		return r, err
+	}
+	if len(r.require)+len(r.forbid)+len(r.requireWhenShared) == 0 {
+		return r, errors.New("needs at least one of require, forbid or require_when_shared")
+	}
+	return r, nil
+}
+
+// parseOptionPatterns parses a list of options from a rule, replacing a nil list with an empty one.
+func parseOptionPatterns(patterns *[]string) (KeyOptions, error) {
+	if *patterns == nil {
+		*patterns = []string{}
+	}
+	opts := make(KeyOptions, 0, len(*patterns))
+	for _, p := range *patterns {
+		o := parseKeyOption(strings.TrimSpace(p))
+		if !stringInStringSlice(o.Name, knownKeyOptions) {
+			return nil, fmt.Errorf("unknown option %q", p)
+		}
+		opts = append(opts, o)
+	}
+	return opts, nil
+}
+
+// matchingOption returns the first of a key's options that a rule's option matches, if there is one.
+func matchingOption(pattern KeyOption, opts KeyOptions) (KeyOption, bool) {
+	for _, o := range opts {
+		if o.Name == pattern.Name && (!pattern.HasValue || o.Value == pattern.Value) {
+			return o, true
+		}
+	}
+	return KeyOption{}, false
+}
+
+// optionText formats a single option as it would be in an authorized_keys file.
+func optionText(o KeyOption) string {
+	return KeyOptions{o}.Strings()[0]
+}
+
+// optionRuleApplies returns true if a rule covers the owner of k, by name, group or UID.
+// Groups are only looked up if the rule names any.
+func (ctx *ScanContext) optionRuleApplies(r *OptionRule, k OwnedPubKey) bool {
+	if len(r.Users) == 0 && len(r.Groups) == 0 && r.uidRange == nil {
+		return true
+	}
+	if stringInStringSlice(k.Owner, r.Users) || (r.uidRange != nil && r.uidRange.Contains(k.OwnerID)) {
+		return true
+	}
+	return len(r.Groups) != 0 && anyInStringSlice(ctx.groupsOf(k.Owner), r.Groups)
+}
+
+// CheckOptionRules returns a problem for every option a key is missing or has against the option rules
+//  that apply to its owner.
+// require_when_shared is checked once per shared key instead, by CheckSharedKeyOptions.
+func (ctx *ScanContext) CheckOptionRules(k OwnedPubKey) []PubKeyProblem {
+	problems := make([]PubKeyProblem, 0)
+	for i := range ctx.Params.OptionRules {
+		r := &ctx.Params.OptionRules[i]
+		if !ctx.optionRuleApplies(r, k) {
+			continue
+		}
+		for _, o := range r.require {
+			if _, ok := matchingOption(o, k.Options); !ok {
+				problems = append(problems, PubKeyProblem{ProblemType: OptionMissing, ProblemKey: k,
+					Detail: fmt.Sprintf("missing %s (option rule %d)", optionText(o), i+1)})
+			}
+		}
+		for _, o := range r.forbid {
+			if found, ok := matchingOption(o, k.Options); ok {
+				problems = append(problems, PubKeyProblem{ProblemType: OptionForbidden, ProblemKey: k,
+					Detail: fmt.Sprintf("has %s (option rule %d)", optionText(found), i+1)})
+			}
+		}
+	}
+	return problems
+}
+
+// CheckSharedKeyOptions returns a problem for each duplicate cluster with a copy of its key missing an option
+//  a require_when_shared rule asks for, with the first such copy as the problem key and every other copy as related.
+// Copies that are permitted for their owner, by key, fingerprint or sharing exemption, aren't checked, nor are
+//  those of ignored users. Keys that are permitted for everyone who has them, or only shared within a sharing
+//  group, aren't in a cluster at all.
+func (ctx *ScanContext) CheckSharedKeyOptions(clusters []DuplicateCluster) []PubKeyProblem {
+	problems := make([]PubKeyProblem, 0)
+	for _, c := range clusters {
+		opks := withoutCertAuthorities(ctx.foundIndex.LookupFingerprint(c.Fingerprint))
+		checked := make([]OwnedPubKey, 0, len(opks))
+		for _, k := range opks {
+			if !ctx.ShouldIgnoreUser(k.Owner, k.OwnerID) && !ctx.IsKeyPermitted(k) {
+				checked = append(checked, k)
+			}
+		}
+
+		missing := make([]string, 0)
+		first := -1
+		for i := range ctx.Params.OptionRules {
+			r := &ctx.Params.OptionRules[i]
+			for _, o := range r.requireWhenShared {
+				count := 0
+				for j, k := range checked {
+					if _, ok := matchingOption(o, k.Options); ok || !ctx.optionRuleApplies(r, k) {
+						continue
+					}
+					count++
+					if first == -1 || j < first {
+						first = j
+					}
+				}
+				if count != 0 {
+					missing = append(missing, fmt.Sprintf("%s (option rule %d) in %d of %d places", optionText(o), i+1, count, len(opks)))
+				}
+			}
+		}
+		if first == -1 {
+			continue
+		}
+
+		related := make([]OwnedPubKey, 0, len(opks)-1)
+		for _, k := range opks {
+			if k.SourceFile != checked[first].SourceFile || k.SourceLine != checked[first].SourceLine || k.Owner != checked[first].Owner {
+				related = append(related, k)
+			}
+		}
+		problems = append(problems, PubKeyProblem{ProblemType: SharedKeyOptionMissing, ProblemKey: checked[first], RelatedKeys: related,
+			Detail: "shared, but missing " + strings.Join(missing, ", ")})
+	}
+	return problems
+}
@@ -0,0 +1,60 @@
+package keyscan
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testKey makes an ed25519 public key from a fixed seed, so that the same seed always gives the same key.
+func testKey(t *testing.T, seed byte) ssh.PublicKey {
+	s := make([]byte, ed25519.SeedSize)
+	s[0] = seed
+	k, err := ssh.NewPublicKey(ed25519.NewKeyFromSeed(s).Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestCheckSharedKeyOptions(t *testing.T) {
+	shared, permitted, alone := testKey(t, 1), testKey(t, 2), testKey(t, 3)
+	found := func(owner string, k ssh.PublicKey, options ...string) OwnedPubKey {
+		return OwnedPubKey{Owner: owner, Key: k, SourceFile: "/home/" + owner + "/.ssh/authorized_keys", SourceLine: 1, Options: ParseKeyOptions(options)}
+	}
+	rule, err := ParseOptionRule(nil, nil, "", nil, nil, []string{"command", "no-pty"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &ScanContext{
+		Params: ScanParams{OptionRules: []OptionRule{rule}},
+		FoundKeys: []OwnedPubKey{
+			found("alice", shared, `command="backup"`),
+			found("bob", shared),
+			found("carol", shared, `command="backup"`),
+			found("alice", permitted),
+			found("bob", permitted),
+			found("dave", alone),
+		},
+		PermittedKeys: []OwnedPubKey{{Key: permitted}},
+	}
+	ctx.ScanKeysForProblems()
+
+	problems := make([]PubKeyProblem, 0)
+	for _, p := range ctx.Problems.OptionProblems {
+		if p.ProblemType == SharedKeyOptionMissing {
+			problems = append(problems, p)
+		}
+	}
+	if len(problems) != 1 {
+		t.Fatalf("got %d shared key problems, want 1 for the one shared key: %+v", len(problems), problems)
+	}
+	p := problems[0]
+	if p.ProblemKey.Owner != "alice" || len(p.RelatedKeys) != 2 {
+		t.Errorf("problem key is %s's, with %d related keys, want alice's, with bob's and carol's", p.ProblemKey.Owner, len(p.RelatedKeys))
+	}
+	if want := "shared, but missing command (option rule 1) in 1 of 3 places, no-pty (option rule 1) in 3 of 3 places"; p.Detail != want {
+		t.Errorf("detail = %q, want %q", p.Detail, want)
+	}
+}
@@ -0,0 +1,113 @@
+package keyscan
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PasswdFile is where the passwd database is read from if getent isn't available.
+const PasswdFile = "/etc/passwd"
+
+// A PasswdEntry is one account from the passwd database.
+// The JSON names are what JSONUserSource expects.
+type PasswdEntry struct {
+	Name  string `json:"name"`
+	UID   int    `json:"uid"`
+	GID   int    `json:"gid"`
+	Home  string `json:"home"`
+	Shell string `json:"shell"`
+}
+
+// ListPasswdEntries returns every account in the passwd database.
+// It asks getent first, so that accounts from LDAP and the like are included, and falls back
+//  to reading /etc/passwd directly if getent can't be run.
+func ListPasswdEntries() ([]PasswdEntry, error) {
+	out, err := exec.Command("getent", "passwd").Output()
+	if err == nil {
+		return ParsePasswd(bytes.NewReader(out))
+	}
+	log.WithFields(log.Fields{"error": err, "file": PasswdFile}).Info("Could not run getent, reading passwd file instead")
+
+	f, err := os.Open(PasswdFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParsePasswd(f)
+}
+
+// ParsePasswd reads passwd(5) format: name:password:uid:gid:gecos:home:shell
+// Blank lines, comments, and NIS compat lines (starting with + or -) are skipped.
+func ParsePasswd(r io.Reader) ([]PasswdEntry, error) {
+	entries := make([]PasswdEntry, 0)
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '+' || line[0] == '-' {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 7 {
+			return entries, fmt.Errorf("passwd line %d: expected 7 fields, got %d", lineNum, len(fields))
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return entries, fmt.Errorf("passwd line %d: invalid uid %q", lineNum, fields[2])
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return entries, fmt.Errorf("passwd line %d: invalid gid %q", lineNum, fields[3])
+		}
+		entries = append(entries, PasswdEntry{Name: fields[0], UID: uid, GID: gid, Home: fields[5], Shell: fields[6]})
+	}
+	return entries, scanner.Err()
+}
+
+// GroupFile is where FileUserDirectory reads groups from by default.
+const GroupFile = "/etc/group"
+
+// A GroupEntry is one group from the group database.
+type GroupEntry struct {
+	Name    string
+	GID     int
+	Members []string // Users who have the group as a supplementary group; members by primary GID aren't listed
+}
+
+// ParseGroup reads group(5) format: name:password:gid:member,member,...
+// Blank lines, comments, and NIS compat lines are skipped, as in ParsePasswd.
+func ParseGroup(r io.Reader) ([]GroupEntry, error) {
+	entries := make([]GroupEntry, 0)
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '+' || line[0] == '-' {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 4 {
+			return entries, fmt.Errorf("group line %d: expected 4 fields, got %d", lineNum, len(fields))
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return entries, fmt.Errorf("group line %d: invalid gid %q", lineNum, fields[2])
+		}
+		members := make([]string, 0)
+		if fields[3] != "" {
+			members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, GroupEntry{Name: fields[0], GID: gid, Members: members})
+	}
+	return entries, scanner.Err()
+}
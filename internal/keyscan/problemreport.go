@@ -1,16 +1,215 @@
 package keyscan
 
 import (
-	"fmt"
-	//log "github.com/sirupsen/logrus"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
 	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
 )
 
+// ReportSchemaVersion is the version of the JSON report format, as described by schema/report.schema.json.
+// Bump the major version for anything that would break an existing consumer, and the minor version for additions.
+const ReportSchemaVersion = "1.10"
+
+// A Report is the top-level JSON document printed at the end of a scan.
+type Report struct {
+	SchemaVersion string        `json:"schema_version"`
+	Metadata      ScanMetadata  `json:"metadata"`
+	Problems      ProblemSet    `json:"problems"`
+	ScanErrors    []ScanError   `json:"scan_errors"` // Anything that stopped keys being gathered, meaning the problems may be incomplete
+	Coverage      ScanCoverage  `json:"coverage"`
+	MissingHomes  []MissingHome `json:"missing_homes"` // Users whose home directories don't exist, if a user source was scanned
+}
+
+// ScanMetadata describes when, where and how a scan was run.
+type ScanMetadata struct {
+	StartTime    time.Time  `json:"start_time"`
+	EndTime      time.Time  `json:"end_time"`
+	Hostname     string     `json:"hostname"`
+	ConfigFile   string     `json:"config_file"` // Empty if the defaults were used
+	Config       ScanParams `json:"config"`
+	FilesScanned []string   `json:"files_scanned"`
+}
+
+// A KeyDescription is how a public key appears in a report: enough to identify it and judge its strength,
+//  without dumping the key's internal structure.
+type KeyDescription struct {
+	Type              string                  `json:"type"`                  // e.g. ssh-rsa, ssh-ed25519
+	Bits              int                     `json:"bits"`                  // Key size, as ssh-keygen -l would report it; 0 if unknown
+	FingerprintSHA256 string                  `json:"fingerprint_sha256"`    // e.g. SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU
+	FingerprintMD5    string                  `json:"fingerprint_md5"`       // e.g. d4:1d:8c:d9:8f:00:b2:04:e9:80:09:98:ec:f8:42:7e
+	AuthorizedKey     string                  `json:"authorized_key"`        // The key in authorized_keys format, without options or comment
+	Certificate       *CertificateDescription `json:"certificate,omitempty"` // What the certificate says, if the key is one
+}
+
+// DescribeKey builds a KeyDescription for a public key.
+func DescribeKey(k ssh.PublicKey) KeyDescription {
+	d := KeyDescription{
+		Type:              k.Type(),
+		Bits:              KeyBits(k),
+		FingerprintSHA256: ssh.FingerprintSHA256(k),
+		FingerprintMD5:    ssh.FingerprintLegacyMD5(k),
+		AuthorizedKey:     strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k))),
+	}
+	if cert, ok := k.(*ssh.Certificate); ok {
+		d.Certificate = DescribeCertificate(cert)
+	}
+	return d
+}
+
+// KeyBits returns the size of a key in bits, or 0 if it's a kind of key we don't know how to measure.
+// For RSA and DSA this is the size of the modulus, for ECDSA the size of the curve.
+// Certificates are measured by the key they certify.
+func KeyBits(k ssh.PublicKey) int {
+	if cert, ok := k.(*ssh.Certificate); ok {
+		return KeyBits(cert.Key)
+	}
+	if cpk, ok := k.(ssh.CryptoPublicKey); ok {
+		switch pk := cpk.CryptoPublicKey().(type) {
+		case *rsa.PublicKey:
+			return pk.N.BitLen()
+		case *dsa.PublicKey:
+			return pk.P.BitLen()
+		case *ecdsa.PublicKey:
+			return pk.Curve.Params().BitSize
+		}
+	}
+	switch k.Type() {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoSKED25519, ssh.KeyAlgoSKECDSA256:
+		return 256
+	}
+	return 0
+}
+
+// MarshalJSON replaces the raw key in an OwnedPubKey with a KeyDescription, because encoding/json makes
+//  a mess of the key structs (e.g. RSA moduli come out as floats).
+func (a OwnedPubKey) MarshalJSON() ([]byte, error) {
+	type plainOwnedPubKey OwnedPubKey // Stops MarshalJSON calling itself
+	return json.Marshal(struct {
+		plainOwnedPubKey
+		Key KeyDescription `json:"key"`
+	}{plainOwnedPubKey(a), DescribeKey(a.Key)})
+}
+
+// MarshalJSON writes problem types out as their text rather than their number, so the report
+//  doesn't depend on the order of the constants.
+func (pt PKProblemType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(GetProblemTypeText(pt))
+}
+
+// NewReport puts together the report for a finished scan.
+func (ctx *ScanContext) NewReport() Report {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Error(err)
+	}
+
+	// Every list in the report should come out as [] rather than null when empty.
+	problems := ctx.Problems
+	if problems.ForbiddenKeys == nil {
+		problems.ForbiddenKeys = []PubKeyProblem{}
+	}
+	if problems.DuplicateClusters == nil {
+		problems.DuplicateClusters = []DuplicateCluster{}
+	}
+	if problems.MalformedEntries == nil {
+		problems.MalformedEntries = []MalformedEntryProblem{}
+	}
+	if problems.WeakKeys == nil {
+		problems.WeakKeys = []PubKeyProblem{}
+	}
+	if problems.OwnershipMismatches == nil {
+		problems.OwnershipMismatches = []OwnershipMismatchProblem{}
+	}
+	if problems.ExpiredExemptions == nil {
+		problems.ExpiredExemptions = []ExpiredExemptionProblem{}
+	}
+	if problems.CertificateProblems == nil {
+		problems.CertificateProblems = []PubKeyProblem{}
+	}
+	if problems.SharedFactors == nil {
+		problems.SharedFactors = []SharedFactorGroup{}
+	}
+	if problems.OptionProblems == nil {
+		problems.OptionProblems = []PubKeyProblem{}
+	}
+	filesScanned := ctx.FilesScanned
+	if filesScanned == nil {
+		filesScanned = []string{}
+	}
+	scanErrors := ctx.ScanErrors
+	if scanErrors == nil {
+		scanErrors = []ScanError{}
+	}
+	missingHomes := ctx.MissingHomes
+	if missingHomes == nil {
+		missingHomes = []MissingHome{}
+	}
+
+	return Report{
+		SchemaVersion: ReportSchemaVersion,
+		Metadata: ScanMetadata{
+			StartTime:    ctx.StartTime,
+			EndTime:      ctx.EndTime,
+			Hostname:     hostname,
+			ConfigFile:   ctx.Params.ConfigFile,
+			Config:       ctx.Params.withEmptyLists(),
+			FilesScanned: filesScanned,
+		},
+		Problems:     problems,
+		ScanErrors:   scanErrors,
+		Coverage:     ctx.Coverage,
+		MissingHomes: missingHomes,
+	}
+}
+
+// withEmptyLists returns a copy of the params with [] in place of any nil list, so the report's config
+//  doesn't show null for e.g. "ignored_owners: []", which viper reads as nil.
+func (p ScanParams) withEmptyLists() ScanParams {
+	for _, l := range []*[]string{&p.TargetGlobs, &p.PermittedKeyFiles, &p.ForbiddenKeyFiles, &p.WeakKeyBlacklistFiles,
+		&p.IgnoredOwners, &p.TrustedFileOwners, &p.IgnoredGroups, &p.ScannedGroups, &p.SharingGroups,
+		&p.PermittedCertAuthorities, &p.AllowedFromNetworks} {
+		if *l == nil {
+			*l = []string{}
+		}
+	}
+	if p.UIDRanges == nil {
+		p.UIDRanges = []UIDRange{}
+	}
+	if p.OptionRules == nil {
+		p.OptionRules = []OptionRule{}
+	}
+	p.KeyPolicy = p.KeyPolicy.withEmptyLists()
+	profiles := make(map[string]KeyPolicy, len(p.PolicyProfiles))
+	for name, kp := range p.PolicyProfiles {
+		profiles[name] = kp.withEmptyLists()
+	}
+	p.PolicyProfiles = profiles
+	return p
+}
+
+func (kp KeyPolicy) withEmptyLists() KeyPolicy {
+	if kp.AllowedKeyTypes == nil {
+		kp.AllowedKeyTypes = []string{}
+	}
+	if kp.AllowedECDSACurves == nil {
+		kp.AllowedECDSACurves = []string{}
+	}
+	return kp
+}
+
 func (ctx *ScanContext) PrintProblemReport() {
-	problemsJsonBytes, err := json.Marshal(ctx.Problems)
-	problemsJsonString := string(problemsJsonBytes)
+	reportJsonBytes, err := json.Marshal(ctx.NewReport())
+	reportJsonString := string(reportJsonBytes)
 	if err != nil {
 		panic(err)
 	}
-	fmt.Println(problemsJsonString)
+	fmt.Println(reportJsonString)
 }
@@ -0,0 +1,42 @@
+package keyscan
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestNewReportEmptyLists(t *testing.T) {
+	ctx := &ScanContext{Params: ScanParams{PolicyProfiles: map[string]KeyPolicy{"service": {MinRSABits: 4096}}}}
+	k := OwnedPubKey{Owner: "alice", Key: testKey(t, 1), SourceFile: "/home/alice/.ssh/authorized_keys", SourceLine: 1, Options: ParseKeyOptions(nil), Kind: "key"}
+	ctx.Problems.AddKeyProblem(PubKeyProblem{ProblemType: KeyTypeNotAllowed, ProblemKey: k})
+	ctx.Problems.AddKeyProblem(PubKeyProblem{ProblemType: OptionMissing, ProblemKey: k, Detail: "missing from"})
+
+	report, err := json.Marshal(ctx.NewReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(report, []byte("null")) {
+		t.Errorf("report has nulls in it, rather than empty lists: %s", report)
+	}
+}
+
+func TestKeyOptionValueInReport(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"from", `{"name":"from","value":"","has_value":false}`},
+		{`from=""`, `{"name":"from","value":"","has_value":true}`},
+		{`from="10.0.0.0/8"`, `{"name":"from","value":"10.0.0.0/8","has_value":true}`},
+	}
+	for _, tt := range tests {
+		got, err := json.Marshal(parseKeyOption(tt.raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s is reported as %s, want %s", tt.raw, got, tt.want)
+		}
+	}
+}
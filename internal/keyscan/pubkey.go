@@ -2,111 +2,203 @@ package keyscan
 
 import (
 	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"golang.org/x/crypto/ssh"
 	"io/ioutil"
+	"strings"
 )
 
 // An OwnedPubKey contains a single ssh public key along with provenance information.
+// In reports, the key itself is replaced by a KeyDescription: see MarshalJSON in problemreport.go.
 type OwnedPubKey struct {
-	Owner      string        // The username of the owner of the file the key came from (text)
-	OwnerID    int           // The uid of that user
-	Key        ssh.PublicKey // The underlying key struct, contains key bytes, comments, options
-	SourceFile string        // The file the key came from
-	SourceLine int           // The line in that file the key came from
-	Comment    string        // The comment on that key in the source file
+	Owner       string        `json:"owner"`         // The user the key is attributed to: by default, the file's owner (see AttributionMode)
+	OwnerID     int           `json:"owner_id"`      // The uid of that user
+	FileOwner   string        `json:"file_owner"`    // The username of the owner of the file the key came from
+	FileOwnerID int           `json:"file_owner_id"` // The uid of that user
+	Account     string        `json:"account"`       // The account the key grants access to, or empty if that couldn't be worked out
+	AccountID   int           `json:"account_id"`    // The uid of that account, or -1
+	Key         ssh.PublicKey `json:"-"`             // The underlying key struct, contains key bytes, comments, options
+	SourceFile  string        `json:"source_file"`   // The file the key came from
+	SourceLine  int           `json:"source_line"`   // The line in that file the key came from
+	Comment     string        `json:"comment"`       // The comment on that key in the source file
+	Options     KeyOptions    `json:"options"`       // Any options given before the key on its line, e.g. from=, command=, restrict
+	Kind        KeyKind       `json:"kind"`          // Whether the line is a plain key, a cert-authority key or a certificate
+}
+
+// A ParsedKeyLine is a single key read from one line of an authorized_keys-format file.
+type ParsedKeyLine struct {
+	Key     ssh.PublicKey
+	Line    int // Line numbers start at 1
+	Comment string
+	Options KeyOptions
+}
+
+// A KeyLineError is a line of an authorized_keys-format file that couldn't be parsed as a key.
+type KeyLineError struct {
+	Line int
+	Err  error
 }
 
 // GetOwnedPubKeysFromFile attempts to get all the keys from an authorized_keys file and return them
 //  as a slice of OwnedPubKeys, labelled with the file's owner and the filename they came from.
-func GetOwnedPubKeysFromFile(filename string) ([]OwnedPubKey, error) {
-	owner, uid, err := getFileOwnerNameAndID(filename)
+// Lines that can't be parsed don't stop the rest of the file being read: they're returned
+//  separately as MalformedEntryProblems.
+// The owner's name is looked up in dir.
+// Any error returned is a *ScanError saying which stage failed.
+func GetOwnedPubKeysFromFile(filename string, dir UserDirectory) ([]OwnedPubKey, []MalformedEntryProblem, error) {
+	keys, _, malformed, err := readOwnedKeyFile(filename, dir, false)
+	return keys, malformed, err
+}
+
+// GetKeysAndFingerprintsFromFile is GetOwnedPubKeysFromFile for forbidden and permitted key files, where
+//  a line can give just a key's fingerprint instead of the whole key.
+func GetKeysAndFingerprintsFromFile(filename string, dir UserDirectory) ([]OwnedPubKey, []FingerprintEntry, []MalformedEntryProblem, error) {
+	return readOwnedKeyFile(filename, dir, true)
+}
+
+func readOwnedKeyFile(filename string, dir UserDirectory, fingerprints bool) ([]OwnedPubKey, []FingerprintEntry, []MalformedEntryProblem, error) {
+	uid, err := getFileOwnerID(filename)
 	if err != nil {
-		return []OwnedPubKey{}, err
+		return []OwnedPubKey{}, []FingerprintEntry{}, []MalformedEntryProblem{}, newFileScanError(filename, StageStat, err)
 	}
-
-	fileBytes, err := ioutil.ReadFile(filename)
+	owner, err := getUsernameForUID(dir, uid)
 	if err != nil {
-		return []OwnedPubKey{}, err
+		return []OwnedPubKey{}, []FingerprintEntry{}, []MalformedEntryProblem{}, newFileScanError(filename, StageOwnerLookup, err)
 	}
 
-	keys, lineNums, comments, err := ParseKeysFromBytes(fileBytes)
+	fileBytes, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return []OwnedPubKey{}, err
+		return []OwnedPubKey{}, []FingerprintEntry{}, []MalformedEntryProblem{}, newFileScanError(filename, StageRead, err)
 	}
+
+	parsedKeys, parsedFingerprints, lineErrors := parseKeyLines(fileBytes, fingerprints)
 	ownedKeys := make([]OwnedPubKey, 0)
-	for i, v := range keys {
-		ownedKeys = append(ownedKeys, OwnedPubKey{Owner: owner, OwnerID: uid, SourceFile: filename, Key: v, SourceLine: lineNums[i], Comment: comments[i]})
+	for _, v := range parsedKeys {
+		ownedKeys = append(ownedKeys, OwnedPubKey{Owner: owner, OwnerID: uid, FileOwner: owner, FileOwnerID: uid, AccountID: -1, SourceFile: filename, Key: v.Key, SourceLine: v.Line, Comment: v.Comment, Options: v.Options, Kind: keyKind(v.Key, v.Options)})
+	}
+	for i := range parsedFingerprints {
+		parsedFingerprints[i].SourceFile = filename
 	}
-	return ownedKeys, nil
+	malformed := make([]MalformedEntryProblem, 0)
+	for _, v := range lineErrors {
+		malformed = append(malformed, MalformedEntryProblem{ProblemType: MalformedEntry, Owner: owner, OwnerID: uid, SourceFile: filename, SourceLine: v.Line, Error: v.Err.Error()})
+	}
+	return ownedKeys, parsedFingerprints, malformed, nil
+}
+
+// ParseKeysFromBytes reads authorized_keys-format data (i.e. file contents) a line at a time, using
+//  ParseAuthorizedKey on each, and returns every key it could parse along with an error for every
+//  line it couldn't.
+// Blank lines and comments are skipped, as sshd does.
+func ParseKeysFromBytes(in []byte) ([]ParsedKeyLine, []KeyLineError) {
+	keys, _, lineErrors := parseKeyLines(in, false)
+	return keys, lineErrors
+}
+
+// ParseKeyListFromBytes is ParseKeysFromBytes for forbidden and permitted key files, which can also have lines
+//  that start with a fingerprint, in either of the forms ParseFingerprint accepts, followed by an optional comment.
+// The FingerprintEntries returned have no SourceFile.
+func ParseKeyListFromBytes(in []byte) ([]ParsedKeyLine, []FingerprintEntry, []KeyLineError) {
+	return parseKeyLines(in, true)
 }
 
-// This is a wrapper around ParseAuthorizedKey to let it read more than one from a byteslice (i.e. file contents).
-func ParseKeysFromBytes(in []byte) ([]ssh.PublicKey, []int, []string, error) {
-	keys := make([]ssh.PublicKey, 0)
-	lineNums := make([]int, 0)
-	comments := make([]string, 0)
+func parseKeyLines(in []byte, fingerprints bool) ([]ParsedKeyLine, []FingerprintEntry, []KeyLineError) {
+	keys := make([]ParsedKeyLine, 0)
+	fps := make([]FingerprintEntry, 0)
+	lineErrors := make([]KeyLineError, 0)
 
-	// remainder is carried over between loop iterations below and used to track progress through a file('s bytes).
-	var remainder []byte
-	remainder = in
+	for i, line := range bytes.Split(in, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if fingerprints {
+			if fp, comment, ok := parseFingerprintLine(line); ok {
+				fps = append(fps, FingerprintEntry{Fingerprint: fp, SourceLine: i + 1, Comment: comment})
+				continue
+			}
+		}
 
-	for len(remainder) != 0 {
 		// This is the prototype for ParseAuthorizedKey:
 		// func ParseAuthorizedKey(in []byte) (out PublicKey, comment string, options []string, rest []byte, err error)
-		var newKey ssh.PublicKey
-		var err error
-		var comment string
-		newKey, comment, _, remainder, err = ssh.ParseAuthorizedKey(remainder)
+		// It will skip over lines it can't parse on its own, so we only ever give it one line.
+		newKey, comment, rawOptions, _, err := ssh.ParseAuthorizedKey(line)
 		if err != nil {
-			return nil, nil, nil, err
-		}
-		keys = append(keys, newKey)
-		lineNums = append(lineNums, getKeyLine(in, remainder))
-		comments = append(comments, comment)
-	}
-	return keys, lineNums, comments, nil
-}
-
-// The key parser takes chunks off the input and leaves the rest in `remainder`.
-// This function returns what line of the input `in` the parser has gotten to, so
-//  we can label the keys with what line of a file they came from.
-func getKeyLine(in []byte, remainder []byte) int {
-	lenIn := len(in)
-	lenRe := len(remainder)
-	// diff should be all the segments cut off by the key parser so far.
-	diff := in[:lenIn-lenRe]
-	numNewLines := bytes.Count(diff, []byte("\n"))
-	return numNewLines
-}
-
-// GetDuplicateKeysFromSlice takes an OwnedPubKey and a slice of OwnedPubKeys and
-//  returns a slice of the OPKs from the slice that have the same key.
-func GetDuplicateKeysFromSlice(k OwnedPubKey, ks []OwnedPubKey) []OwnedPubKey {
-	dupes := make([]OwnedPubKey, 0)
-	for _, v := range ks {
-		if k.HasSameKeyAs(v) {
-			dupes = append(dupes, v)
+			lineErrors = append(lineErrors, KeyLineError{Line: i + 1, Err: diagnoseKeyLine(line)})
+			continue
 		}
+		keys = append(keys, ParsedKeyLine{Key: newKey, Line: i + 1, Comment: comment, Options: ParseKeyOptions(rawOptions)})
 	}
-	return dupes
+	return keys, fps, lineErrors
 }
 
-// IsKeyInSlice takes an OwnedPubKey k and a slice of OwnedPubKeys and
-//  returns true if k's key occurs in in the slice.
-// (It's very similar to GetDuplicateKeysFromSlice but short-circuits.)
-func IsKeyInSlice(k OwnedPubKey, ks []OwnedPubKey) bool {
-	for _, v := range ks {
-		if k.HasSameKeyAs(v) {
-			return true
+// parseFingerprintLine returns the fingerprint a line starts with, and the rest of the line as a comment.
+func parseFingerprintLine(line []byte) (string, string, bool) {
+	first := bytes.Fields(line)[0] // line has already been trimmed, so this is where it starts
+	fp, ok := ParseFingerprint(string(first))
+	if !ok {
+		return "", "", false
+	}
+	return fp, string(bytes.TrimSpace(line[len(first):])), true
+}
+
+// diagnoseKeyLine tries to work out why a line couldn't be parsed, because ParseAuthorizedKey
+//  only ever says "no key found".
+func diagnoseKeyLine(line []byte) error {
+	fields := bytes.Fields(line)
+	for i, f := range fields {
+		if !isKnownKeyAlgo(string(f)) {
+			continue
+		}
+		if i+1 >= len(fields) {
+			return fmt.Errorf("no key data after key type %q", f)
+		}
+		keyBytes, err := base64.StdEncoding.DecodeString(string(fields[i+1]))
+		if err != nil {
+			return fmt.Errorf("key data is not valid base64: %v", err)
+		}
+		key, err := ssh.ParsePublicKey(keyBytes)
+		if err != nil {
+			return err
+		}
+		if key.Type() != string(f) {
+			return fmt.Errorf("key type %q does not match key data type %q", f, key.Type())
 		}
+		return errors.New("could not parse options before key type")
+	}
+	if _, ok := ParseFingerprint(string(fields[0])); ok {
+		return errors.New("this is a key fingerprint, not a key")
+	}
+	if prefix := strings.ToUpper(string(fields[0])); strings.HasPrefix(prefix, "SHA256:") || strings.HasPrefix(prefix, "MD5:") {
+		return fmt.Errorf("invalid key fingerprint %q", fields[0])
+	}
+	if len(fields) >= 3 && isAllDigits(fields[0]) && isAllDigits(fields[1]) {
+		return errors.New("SSH protocol 1 keys are not supported")
+	}
+	return errors.New("no recognised key type found")
+}
+
+// isKnownKeyAlgo returns true if s is the name of a key or certificate type the ssh package can parse.
+func isKnownKeyAlgo(s string) bool {
+	switch s {
+	case ssh.KeyAlgoRSA, ssh.KeyAlgoDSA, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoSKECDSA256, ssh.KeyAlgoED25519, ssh.KeyAlgoSKED25519,
+		ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01, ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01,
+		ssh.CertAlgoECDSA521v01, ssh.CertAlgoSKECDSA256v01, ssh.CertAlgoED25519v01, ssh.CertAlgoSKED25519v01:
+		return true
 	}
 	return false
 }
 
-// HasSameKeyAs compares the public key for an OwnedPubKey struct using IsKeyInOwnedPubKeyEqual in an OO-y way.
-// Returns true if the two keys are the same.
-func (a OwnedPubKey) HasSameKeyAs(b OwnedPubKey) bool {
-	return IsKeyInOwnedPubKeyEqual(a, b)
+func isAllDigits(b []byte) bool {
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(b) != 0
 }
 
 // IsKeyInOwnedPubKeyEqual compares two OwnedPubKeys and returns true if the public keys they contain are the same.
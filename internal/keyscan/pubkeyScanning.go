@@ -1,35 +1,90 @@
 package keyscan
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
 )
 
 // Go runs the whole scan based on params.
 func (ctx *ScanContext) Go() {
-	ctx.GatherKeysToScanFromGlobs(ctx.Params.TargetGlobs)
-	ctx.GatherForbiddenKeysFromFiles(ctx.Params.PermittedKeyFiles)
-	ctx.GatherPermittedKeysFromFiles(ctx.Params.ForbiddenKeyFiles)
+	ctx.StartTime = time.Now()
+	ctx.GatherKeysToScan()
+	ctx.GatherForbiddenKeysFromFiles(ctx.Params.ForbiddenKeyFiles)
+	ctx.GatherPermittedKeysFromFiles(ctx.Params.PermittedKeyFiles)
+	ctx.GatherWeakKeyBlacklistFromFiles(ctx.Params.WeakKeyBlacklistFiles)
 	ctx.ScanKeysForProblems()
+	ctx.ScanForSharedFactors()
+	ctx.EndTime = time.Now()
 	ctx.PrintProblemReport()
 }
 
 // ScanParams contains all the lists of things we need to check for while scanning for duplicate public keys.
+// The JSON names match the config file keys, so the report can show the configuration that was used.
 type ScanParams struct {
-	TargetGlobs       []string // List of files to parse and scan keys from.
-	PermittedKeyFiles []string // List of files containing keys that are explicitly allowed to be owned by multiple users.
-	ForbiddenKeyFiles []string // List of files containing keys that cannot be used by any user.
-	IgnoredOwners     []string // Users whose keys are ignored in scans.
-	LowerUIDBound     int      // Ignore system users, with UIDs below this. (e.g. root, nobody, cups)
-	// IgnoredGroups []string // TODO Later?
+	ConfigFile               string               `json:"-"`                        // The config file these params were read from, if any.
+	TargetGlobs              []string             `json:"target_globs"`             // List of files to parse and scan keys from.
+	PermittedKeyFiles        []string             `json:"permitted_key_files"`      // List of files containing keys that are explicitly allowed to be owned by multiple users.
+	ForbiddenKeyFiles        []string             `json:"forbidden_key_files"`      // List of files containing keys that cannot be used by any user.
+	WeakKeyBlacklistFiles    []string             `json:"weak_key_blacklist_files"` // openssh-blacklist format files of keys from Debian's broken OpenSSL.
+	IgnoredOwners            []string             `json:"ignored_owners"`           // Users whose keys are ignored in scans.
+	LowerUIDBound            int                  `json:"lower_uid_bound"`          // Ignore system users, with UIDs below this. (e.g. root, nobody, cups) Only used if there are no UIDRanges.
+	UIDRanges                []UIDRange           `json:"uid_ranges"`               // Ignore, scan or apply a policy profile to users by UID. The first range a UID is in applies.
+	PolicyProfiles           map[string]KeyPolicy `json:"policy_profiles"`          // Named key policies for UID ranges to use instead of KeyPolicy.
+	Parallelism              int                  `json:"parallelism"`              // How many key files to read at once. Less than 2 reads them one at a time.
+	FileTimeout              int                  `json:"file_timeout_seconds"`     // Give up on a key file after this many seconds. 0 waits forever.
+	SSHDConfigFile           string               `json:"sshd_config_file"`         // If set, also scan the files this sshd_config's AuthorizedKeysFile points to, for every user.
+	Attribution              AttributionMode      `json:"attribution"`              // Whether keys are checked as belonging to the account they grant access to, or the file's owner.
+	TrustedFileOwners        []string             `json:"trusted_file_owners"`      // Users who may own other accounts' key files without it being a problem. (e.g. root)
+	UserSource               string               `json:"user_source"`              // If set, go through every user from this source (getent, passwd or json) and scan their key files.
+	UserSourceFile           string               `json:"user_source_file"`         // The file for the passwd and json user sources.
+	SkipNologinUsers         bool                 `json:"skip_nologin_users"`       // Don't look for keys for users whose shell is nologin or false.
+	KeyPolicy                                     // Which algorithms and key sizes are acceptable.
+	DirectoryParams                               // Where users and groups are looked up, e.g. to find who owns a file.
+	IgnoredGroups            []string             `json:"ignored_groups"`             // Members of these groups are ignored, as if they were ignored owners.
+	ScannedGroups            []string             `json:"scanned_groups"`             // If not empty, only members of these groups are scanned: everyone else is ignored.
+	SharingGroups            []string             `json:"sharing_groups"`             // Members of one of these groups may share keys with each other, but not with anyone outside it.
+	PermittedCertAuthorities []string             `json:"permitted_cert_authorities"` // If not empty, cert-authority keys must have one of these fingerprints, in the form ParseFingerprint returns.
+	SharedFactorAnalysis     bool                 `json:"shared_factor_analysis"`     // Look for RSA keys that share a prime factor, across every key found.
+	OptionRules              []OptionRule         `json:"option_rules"`               // Which authorized_keys options some or all users' keys must or mustn't have.
+	AllowedFromNetworks      []string             `json:"allowed_from_networks"`      // If not empty, address and network patterns in from= options must be within one of these.
 }
 
 // ScanContext is a container for all the data about a scan for keys.
 type ScanContext struct {
-	Params        ScanParams    // Configuration options.
-	FoundKeys     []OwnedPubKey // All the keys that have been found from files and will be checked.
-	PermittedKeys []OwnedPubKey // Keys that are explicitly allowed to be owned by multiple users.
-	ForbiddenKeys []OwnedPubKey // Keys that are cannot be used by any user.
-	Problems      ProblemSet    // Any problems found during the scan.
+	Params                ScanParams         // Configuration options.
+	FoundKeys             []OwnedPubKey      // All the keys that have been found from files and will be checked.
+	PermittedKeys         []OwnedPubKey      // Keys that are explicitly allowed to be owned by multiple users.
+	PermittedFingerprints []FingerprintEntry // Like PermittedKeys, but only the fingerprint is known.
+	SharingExemptions     []SharingExemption // Keys that are allowed to be shared, but only by some users, or only for a while.
+	ForbiddenKeys         []OwnedPubKey      // Keys that are cannot be used by any user.
+	ForbiddenFingerprints []FingerprintEntry // Like ForbiddenKeys, but only the fingerprint is known.
+	RevocationLists       []*KRL             // Forbidden key files in KRL format, revoking keys and certificates.
+	WeakKeyBlacklist      *WeakKeyBlacklist  // Keys known to be compromised, from the weak key blacklist files.
+	Problems              ProblemSet         // Any problems found during the scan.
+	FilesScanned          []string           // Every file keys to scan were looked for in, whether or not it could be read.
+	ScanErrors            []ScanError        // Everything that went wrong while gathering keys, which may mean keys were missed.
+	Coverage              ScanCoverage       // How many of the files to scan were read, and how many keys were in them.
+	MissingHomes          []MissingHome      // Users from the user source whose home directories don't exist.
+	StartTime             time.Time          // When Go started the scan.
+	EndTime               time.Time          // When Go finished scanning, before the report was printed.
+
+	// These are built from the key slices above at the start of ScanKeysForProblems.
+	foundIndex       *KeyIndex
+	permittedIndex   *KeyIndex
+	forbiddenIndex   *KeyIndex
+	permittedFPIndex *FingerprintIndex
+	forbiddenFPIndex *FingerprintIndex
+
+	failedOwnerLookups map[string]bool     // So that each user we can't look up is only recorded as an error once.
+	passwdEntries      []PasswdEntry       // Read when first needed, by passwdUsers.
+	directory          UserDirectory       // Made when first needed, by userDirectory.
+	groupsByUser       map[string][]string // Each user's groups, once they've been looked up by userGroups or groupsOf.
 }
 
 type PKProblemType uint
@@ -38,26 +93,89 @@ const (
 	NoProblem PKProblemType = iota //
 	KeyForbidden
 	DuplicateKey
-	// KeyTypeDeprecated // TODO Later?
+	MalformedEntry
+	KeyTypeDeprecated
+	KeyTooSmall
+	ECDSACurveNotAllowed
+	KeyTypeNotAllowed
+	OwnershipMismatch
+	ExpiredExemption
+	UnapprovedCertAuthority
+	CertificateExpired
+	WeakKeyKnownCompromised
+	KeyROCAVulnerable
+	SharedFactor
+	OptionMissing
+	OptionForbidden
+	SharedKeyOptionMissing
+	FromPatternInvalid
+	FromPatternTooBroad
+	FromPatternNotAllowed
 )
 
 // GetProblemTypeText gets a textual description from numeric problem class ID.
 func GetProblemTypeText(pt PKProblemType) string {
-	problemTypeTexts := []string{"No Problem", "Forbidden Key", "Duplicate Key"}
+	problemTypeTexts := []string{"No Problem", "Forbidden Key", "Duplicate Key", "Malformed Entry",
+		"Deprecated Key Type", "Key Too Small", "ECDSA Curve Not Allowed", "Key Type Not Allowed",
+		"Key File Owner Does Not Match Account", "Sharing Exemption Expired",
+		"Unapproved Certificate Authority", "Certificate Expired", "Known Compromised Weak Key",
+		"ROCA Vulnerable Key", "Shared RSA Factor", "Required Option Missing", "Forbidden Option Present",
+		"Shared Key Missing Required Option", "Invalid From Pattern", "From Pattern Too Broad",
+		"From Pattern Outside Allowed Networks"}
 	return problemTypeTexts[uint(pt)]
 }
 
 // ProblemSet is contained by ScanContext to classify the problems we find.
 type ProblemSet struct {
-	ForbiddenKeys []PubKeyProblem
-	DuplicateKeys []PubKeyProblem
+	ForbiddenKeys       []PubKeyProblem            `json:"forbidden_keys"`
+	DuplicateClusters   []DuplicateCluster         `json:"duplicate_clusters"`
+	MalformedEntries    []MalformedEntryProblem    `json:"malformed_entries"`
+	WeakKeys            []PubKeyProblem            `json:"weak_keys"`            // Keys that fall short of the KeyPolicy, or are known to be compromised
+	OwnershipMismatches []OwnershipMismatchProblem `json:"ownership_mismatches"` // Key files owned by someone other than the account they're for
+	ExpiredExemptions   []ExpiredExemptionProblem  `json:"expired_exemptions"`   // Sharing exemptions that have run out for keys still in use
+	CertificateProblems []PubKeyProblem            `json:"certificate_problems"` // cert-authority keys that aren't permitted, and expired certificates
+	SharedFactors       []SharedFactorGroup        `json:"shared_factors"`       // RSA keys that can be factored because they share primes, if that was looked for
+	OptionProblems      []PubKeyProblem            `json:"option_problems"`      // Keys breaking the option rules, or with bad from= restrictions
+}
+
+// AddKeyProblem files a PubKeyProblem under the right heading for its type.
+func (ps *ProblemSet) AddKeyProblem(p PubKeyProblem) {
+	if p.RelatedKeys == nil {
+		p.RelatedKeys = []OwnedPubKey{} // So it comes out as [] in the report, like every other list
+	}
+	switch p.ProblemType {
+	case KeyForbidden:
+		ps.ForbiddenKeys = append(ps.ForbiddenKeys, p)
+	case KeyTypeDeprecated, KeyTooSmall, ECDSACurveNotAllowed, KeyTypeNotAllowed, WeakKeyKnownCompromised, KeyROCAVulnerable:
+		ps.WeakKeys = append(ps.WeakKeys, p)
+	case UnapprovedCertAuthority, CertificateExpired:
+		ps.CertificateProblems = append(ps.CertificateProblems, p)
+	case OptionMissing, OptionForbidden, SharedKeyOptionMissing, FromPatternInvalid, FromPatternTooBroad, FromPatternNotAllowed:
+		ps.OptionProblems = append(ps.OptionProblems, p)
+	default:
+		log.WithFields(log.Fields{"class": GetProblemTypeText(p.ProblemType)}).Error("Internal problem: no heading for key problem type")
+	}
 }
 
 // PubKeyProblem contains one problem found during a scan, along with the keys that were problematic.
 type PubKeyProblem struct {
-	ProblemType PKProblemType
-	ProblemKey  OwnedPubKey
-	RelatedKeys []OwnedPubKey
+	ProblemType         PKProblemType      `json:"problem_type"`
+	ProblemKey          OwnedPubKey        `json:"problem_key"`
+	RelatedKeys         []OwnedPubKey      `json:"related_keys"`
+	RelatedFingerprints []FingerprintEntry `json:"related_fingerprints,omitempty"` // Fingerprint entries involved, e.g. in the forbidden key files
+	Detail              string             `json:"detail,omitempty"`               // A human-readable explanation, where the type alone doesn't say enough
+}
+
+// MalformedEntryProblem is a line in a key file that couldn't be parsed as a key.
+// It's a problem in its own right, because sshd will ignore that line too, but the rest
+//  of the file is still read and checked.
+type MalformedEntryProblem struct {
+	ProblemType PKProblemType `json:"problem_type"`
+	Owner       string        `json:"owner"`    // The user the file is attributed to, as for OwnedPubKey
+	OwnerID     int           `json:"owner_id"` // The uid of that user
+	SourceFile  string        `json:"source_file"`
+	SourceLine  int           `json:"source_line"`
+	Error       string        `json:"error"` // What the parser thinks is wrong with the line
 }
 
 func appendEachKey(a []OwnedPubKey, b []OwnedPubKey) []OwnedPubKey {
@@ -67,152 +185,395 @@ func appendEachKey(a []OwnedPubKey, b []OwnedPubKey) []OwnedPubKey {
 	return a
 }
 
-func (ctx *ScanContext) GatherKeysToScanFromGlobs(globs []string) {
-	filenames, err := GetPathsByGlob(ctx.Params.TargetGlobs)
-	if err != nil {
-		log.Error(err)
+// recordScanErrors logs errors that happened during the scan and keeps them so they can be reported.
+func (ctx *ScanContext) recordScanErrors(errs ...ScanError) {
+	for _, err := range errs {
+		log.WithFields(log.Fields{"stage": err.Stage}).Error(err.Error())
+		ctx.ScanErrors = append(ctx.ScanErrors, err)
 	}
-	ctx.GatherKeysToScanFromFiles(filenames)
+}
+
+// HasErrors returns true if anything went wrong while gathering keys, meaning the scan may be incomplete.
+func (ctx *ScanContext) HasErrors() bool {
+	return len(ctx.ScanErrors) != 0
+}
+
+func (ctx *ScanContext) GatherKeysToScanFromGlobs(globs []string) {
+	ctx.GatherKeysToScanFromTargets(ctx.globTargets(globs))
 }
 
 func (ctx *ScanContext) GatherKeysToScanFromFiles(filenames []string) {
-	opks := GatherKeysFromFiles(filenames)
-	ctx.FoundKeys = appendEachKey(ctx.FoundKeys, opks)
+	ctx.GatherKeysToScanFromTargets(pathTargets(filenames))
 }
 
+// GatherForbiddenKeysFromFiles reads forbidden keys, and fingerprints of forbidden keys, from authorized_keys format files,
+//  and revocations from KRLs, as sshd reads from RevokedKeys.
 func (ctx *ScanContext) GatherForbiddenKeysFromFiles(filenames []string) {
-	opks := GatherKeysFromFiles(filenames)
-	ctx.ForbiddenKeys = appendEachKey(ctx.ForbiddenKeys, opks)
+	for _, r := range ctx.addFileResults(ctx.gatherKeyListsFromFiles(filenames)) {
+		ctx.ForbiddenKeys = appendEachKey(ctx.ForbiddenKeys, r.Keys)
+		ctx.ForbiddenFingerprints = append(ctx.ForbiddenFingerprints, r.Fingerprints...)
+		if r.RevocationList != nil {
+			ctx.RevocationLists = append(ctx.RevocationLists, r.RevocationList)
+		}
+	}
 }
 
+// GatherPermittedKeysFromFiles reads permitted keys, and fingerprints of permitted keys, from authorized_keys
+//  format files, and sharing exemptions from YAML files (ending in .yaml or .yml).
 func (ctx *ScanContext) GatherPermittedKeysFromFiles(filenames []string) {
-	opks := GatherKeysFromFiles(filenames)
-	ctx.PermittedKeys = appendEachKey(ctx.PermittedKeys, opks)
-}
-
-// GatherKeysFromFiles takes a slice of filenames and returns all the public keys it finds in them with metadata attached.
-func GatherKeysFromFiles(filenames []string) []OwnedPubKey {
-	opks := make([]OwnedPubKey, 0)
-	for _, name := range filenames {
-		numKeys := 0
-		log.WithFields(log.Fields{"file": name}).Debug("Getting keys from new file")
-		keys, err := GetOwnedPubKeysFromFile(name)
-		if err != nil {
-			log.Error(err)
+	keyFiles := make([]string, 0, len(filenames))
+	for _, f := range filenames {
+		if isPermittedKeysYAML(f) {
+			ctx.GatherSharingExemptionsFromFile(f)
+		} else {
+			keyFiles = append(keyFiles, f)
+		}
+	}
+	for _, r := range ctx.addFileResults(ctx.gatherKeyListsFromFiles(keyFiles)) {
+		ctx.PermittedKeys = appendEachKey(ctx.PermittedKeys, r.Keys)
+		ctx.PermittedFingerprints = append(ctx.PermittedFingerprints, r.Fingerprints...)
+		if r.RevocationList != nil {
+			ctx.recordScanErrors(ScanError{Path: r.Path, Stage: StageParse, Err: errors.New("a KRL can only be a forbidden key file")})
 		}
-		numKeys += len(keys)
-		for _, key := range keys {
-			log.WithFields(log.Fields{"owner": key.Owner, "source": key.SourceFile}).Debug("Adding found key")
-			opks = append(opks, key)
+	}
+}
+
+// A KeyFileResult is everything that came out of reading one key file.
+type KeyFileResult struct {
+	Path           string
+	Keys           []OwnedPubKey
+	Fingerprints   []FingerprintEntry // Only from forbidden and permitted key files
+	RevocationList *KRL               // If a forbidden or permitted key file was a KRL rather than a list of keys
+	Malformed      []MalformedEntryProblem
+	Err            *ScanError // nil if the file could be read
+}
+
+// ReadKeyFile gets all the keys from one file, keeping any lines that couldn't be parsed and any error reading it.
+// The file's owner is looked up in dir.
+func ReadKeyFile(name string, dir UserDirectory) KeyFileResult {
+	return readKeyFile(name, dir, false)
+}
+
+// ReadKeyListFile is ReadKeyFile for forbidden and permitted key files, which can give fingerprints as well as keys,
+//  or be KRLs.
+func ReadKeyListFile(name string, dir UserDirectory) KeyFileResult {
+	if isKRLFile(name) {
+		return readKRLFile(name)
+	}
+	return readKeyFile(name, dir, true)
+}
+
+func readKRLFile(name string) KeyFileResult {
+	krl, err := ReadKRL(name)
+	if err != nil {
+		se := asScanError(err, name, StageParse)
+		return KeyFileResult{Path: name, Err: &se}
+	}
+	log.WithFields(log.Fields{"file": name, "krl_version": krl.Version, "revocations": krl.Len()}).Debug("Read key revocation list")
+	return KeyFileResult{Path: name, RevocationList: krl}
+}
+
+func readKeyFile(name string, dir UserDirectory, fingerprints bool) KeyFileResult {
+	log.WithFields(log.Fields{"file": name}).Debug("Getting keys from new file")
+	keys, fps, badLines, err := readOwnedKeyFile(name, dir, fingerprints)
+	r := KeyFileResult{Path: name, Keys: keys, Fingerprints: fps, Malformed: badLines}
+	if err != nil {
+		se := asScanError(err, name, StageRead)
+		r.Err = &se
+	}
+	for _, key := range keys {
+		log.WithFields(log.Fields{"owner": key.Owner, "source": key.SourceFile}).Debug("Adding found key")
+	}
+	for _, bad := range badLines {
+		log.WithFields(log.Fields{"file": name, "line": bad.SourceLine, "error": bad.Error}).Warn("Skipping malformed line")
+	}
+	log.WithFields(log.Fields{"new_keys": len(keys), "new_fingerprints": len(fps), "malformed_lines": len(badLines), "file": name}).Debug("Key gathering from file complete")
+	return r
+}
+
+// A keyFileReader is ReadKeyFile or ReadKeyListFile.
+type keyFileReader func(name string, dir UserDirectory) KeyFileResult
+
+// readKeyFileWithTimeout reads a file with read, but gives up waiting after timeout (if it's more than 0) and
+//  returns a ScanError instead.
+// A hung stat or read can't be interrupted, so the goroutine doing it is left behind, and its result
+//  thrown away if it ever finishes.
+func readKeyFileWithTimeout(read keyFileReader, name string, dir UserDirectory, timeout time.Duration) KeyFileResult {
+	if timeout <= 0 {
+		return read(name, dir)
+	}
+	done := make(chan KeyFileResult, 1) // Buffered, so an abandoned read can still send and exit
+	go func() {
+		done <- read(name, dir)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r
+	case <-timer.C:
+		return KeyFileResult{Path: name, Err: &ScanError{Path: name, Stage: StageRead, Err: fmt.Errorf("timed out after %v", timeout)}}
+	}
+}
+
+// GatherKeysFromFiles takes a slice of filenames and reads the keys from each, returning what was found in
+//  each file in the same order as the filenames.
+// Up to parallelism files are read at once, and any file that takes longer than timeout is given up on.
+// dir is used from all of them at once, so it must be safe for that, e.g. a CachingUserDirectory.
+func GatherKeysFromFiles(filenames []string, dir UserDirectory, parallelism int, timeout time.Duration) []KeyFileResult {
+	return gatherFiles(ReadKeyFile, filenames, dir, parallelism, timeout)
+}
+
+// GatherKeyListsFromFiles is GatherKeysFromFiles for forbidden and permitted key files, using ReadKeyListFile.
+func GatherKeyListsFromFiles(filenames []string, dir UserDirectory, parallelism int, timeout time.Duration) []KeyFileResult {
+	return gatherFiles(ReadKeyListFile, filenames, dir, parallelism, timeout)
+}
+
+func gatherFiles(read keyFileReader, filenames []string, dir UserDirectory, parallelism int, timeout time.Duration) []KeyFileResult {
+	results := make([]KeyFileResult, len(filenames))
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	log.WithFields(log.Fields{"files": len(filenames), "parallelism": parallelism}).Debug("Reading key files")
+
+	// Each worker writes only to its own files' slots in results, so the order doesn't depend on which finishes first.
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism && w < len(filenames); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = readKeyFileWithTimeout(read, filenames[i], dir, timeout)
+			}
+		}()
+	}
+	for i := range filenames {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// gatherKeysFromFiles is GatherKeysFromFiles with the user directory, parallelism and timeout from the scan params.
+func (ctx *ScanContext) gatherKeysFromFiles(filenames []string) []KeyFileResult {
+	return GatherKeysFromFiles(filenames, ctx.userDirectory(), ctx.Params.Parallelism, time.Duration(ctx.Params.FileTimeout)*time.Second)
+}
+
+// gatherKeyListsFromFiles is GatherKeyListsFromFiles with the user directory, parallelism and timeout from the scan params.
+func (ctx *ScanContext) gatherKeyListsFromFiles(filenames []string) []KeyFileResult {
+	return GatherKeyListsFromFiles(filenames, ctx.userDirectory(), ctx.Params.Parallelism, time.Duration(ctx.Params.FileTimeout)*time.Second)
+}
+
+// addFileResults records the malformed lines and errors from a set of key file results in the context,
+//  and passes the results back for the caller to take the keys from.
+func (ctx *ScanContext) addFileResults(results []KeyFileResult) []KeyFileResult {
+	for _, r := range results {
+		ctx.Problems.MalformedEntries = append(ctx.Problems.MalformedEntries, r.Malformed...)
+		if r.Err != nil {
+			ctx.recordScanErrors(*r.Err)
 		}
-		log.WithFields(log.Fields{"new_keys": numKeys, "file": name}).Debug("Key gathering from file complete")
 	}
-	return opks
+	return results
 }
 
 // ScanKeysForProblems scans all a context's found keys for problems, and return true if any were found, false otherwise.
 func (ctx *ScanContext) ScanKeysForProblems() bool {
 	log.Debug("Context starting scan for problems")
-	anyProblems := false
+	ctx.buildIndexes()
+	anyProblems := len(ctx.Problems.MalformedEntries) != 0
 	for _, v := range ctx.FoundKeys {
 		log.WithFields(log.Fields{"owner": v.Owner, "source": v.SourceFile}).Debug("Checking key")
-		isProblem, keyProblem := ctx.IsKeyAProblem(v)
+		isProblem, keyProblems := ctx.IsKeyAProblem(v)
 		if isProblem {
 			anyProblems = true
-			log.WithFields(log.Fields{"class": keyProblem.ProblemType}).Debug("Problem detected")
-			if keyProblem.ProblemType == KeyForbidden {
-				ctx.Problems.ForbiddenKeys = append(ctx.Problems.ForbiddenKeys, keyProblem)
-			}
-			if keyProblem.ProblemType == DuplicateKey {
-				ctx.Problems.DuplicateKeys = append(ctx.Problems.DuplicateKeys, keyProblem)
+			for _, keyProblem := range keyProblems {
+				log.WithFields(log.Fields{"class": GetProblemTypeText(keyProblem.ProblemType)}).Debug("Problem detected")
+				ctx.Problems.AddKeyProblem(keyProblem)
 			}
 		}
 	}
-	log.WithFields(log.Fields{"duplicate_keys": len(ctx.Problems.DuplicateKeys), "forbidden_keys": len(ctx.Problems.ForbiddenKeys)}).Info("Problem scan complete")
+	// Duplicates are a property of a key rather than of each place it's found, so they're grouped separately.
+	ctx.Problems.DuplicateClusters = ctx.FindDuplicateClusters()
+	if len(ctx.Problems.DuplicateClusters) != 0 {
+		anyProblems = true
+	}
+	for _, p := range ctx.CheckSharedKeyOptions(ctx.Problems.DuplicateClusters) {
+		anyProblems = true
+		ctx.Problems.AddKeyProblem(p)
+	}
+	ctx.Problems.OwnershipMismatches = ctx.FindOwnershipMismatches()
+	if len(ctx.Problems.OwnershipMismatches) != 0 {
+		anyProblems = true
+	}
+	ctx.Problems.ExpiredExemptions = ctx.FindExpiredExemptions()
+	if len(ctx.Problems.ExpiredExemptions) != 0 {
+		anyProblems = true
+	}
+	log.WithFields(log.Fields{"duplicate_clusters": len(ctx.Problems.DuplicateClusters), "ownership_mismatches": len(ctx.Problems.OwnershipMismatches), "expired_exemptions": len(ctx.Problems.ExpiredExemptions), "forbidden_keys": len(ctx.Problems.ForbiddenKeys), "weak_keys": len(ctx.Problems.WeakKeys), "certificate_problems": len(ctx.Problems.CertificateProblems), "option_problems": len(ctx.Problems.OptionProblems), "malformed_entries": len(ctx.Problems.MalformedEntries)}).Info("Problem scan complete")
 	return anyProblems
 }
 
-func (ctx *ScanContext) IsKeyAProblem(k OwnedPubKey) (bool, PubKeyProblem) {
-	if ctx.IsKeyPermitted(k) {
-		return false, PubKeyProblem{}
+// buildIndexes (re)builds the fingerprint indexes for the found, permitted and forbidden keys, and the
+//  permitted and forbidden fingerprints.
+func (ctx *ScanContext) buildIndexes() {
+	ctx.foundIndex = NewKeyIndex(ctx.FoundKeys)
+	ctx.permittedIndex = NewKeyIndex(ctx.PermittedKeys)
+	ctx.forbiddenIndex = NewKeyIndex(ctx.ForbiddenKeys)
+	ctx.permittedFPIndex = NewFingerprintIndex(ctx.PermittedFingerprints)
+	ctx.forbiddenFPIndex = NewFingerprintIndex(ctx.ForbiddenFingerprints)
+	log.WithFields(log.Fields{"distinct_found": ctx.foundIndex.Len(), "distinct_permitted": ctx.permittedIndex.Len(), "distinct_forbidden": ctx.forbiddenIndex.Len(), "permitted_fingerprints": ctx.permittedFPIndex.Len(), "forbidden_fingerprints": ctx.forbiddenFPIndex.Len()}).Debug("Key indexes built")
+}
+
+// IsKeyAProblem checks a single found key against everything except duplication, and returns true and all
+//  the problems found if there were any.
+// Permitting a key in the permitted key files exempts it from being forbidden, but not from the key strength policy
+//  or the checks for known compromised and factorable keys. A sharing exemption doesn't: it only allows sharing.
+func (ctx *ScanContext) IsKeyAProblem(k OwnedPubKey) (bool, []PubKeyProblem) {
+	problems := make([]PubKeyProblem, 0)
+	if ctx.ShouldIgnoreUser(k.Owner, k.OwnerID) {
+		return false, problems
 	}
-	if ctx.ShouldIgnoreOwner(k.Owner) {
-		return false, PubKeyProblem{}
+	if ctx.IsKeyForbidden(k) && !ctx.isPermittedForAnyone(k.Key) {
+		p := PubKeyProblem{ProblemType: KeyForbidden, ProblemKey: k, RelatedKeys: ctx.FindKeysForbidding(k), RelatedFingerprints: ctx.FindFingerprintsForbidding(k)}
+		details := ctx.FindRevocations(k)
+		if len(p.RelatedKeys) == 0 && len(p.RelatedFingerprints) != 0 {
+			// There's no key to show from the forbidden key files, so say where the fingerprint was.
+			fp := p.RelatedFingerprints[0]
+			details = append([]string{fmt.Sprintf("matches fingerprint %s at %s:%d", fp.Fingerprint, fp.SourceFile, fp.SourceLine)}, details...)
+		}
+		p.Detail = strings.Join(details, "; ")
+		problems = append(problems, p)
 	}
-	if ctx.IsKeyForbidden(k) {
-		forbidding := ctx.FindKeysForbidding(k)
-		p := PubKeyProblem{ProblemType: KeyForbidden, ProblemKey: k, RelatedKeys: forbidding}
-		return true, p
+	policy, profile := ctx.Params.KeyPolicyFor(k)
+	for _, p := range policy.CheckKey(k) {
+		if profile != "" {
+			p.Detail += fmt.Sprintf(" (policy profile %s)", profile)
+		}
+		problems = append(problems, p)
+	}
+	if e, ok := ctx.WeakKeyBlacklist.Lookup(k.Key); ok {
+		problems = append(problems, PubKeyProblem{ProblemType: WeakKeyKnownCompromised, ProblemKey: k, RelatedFingerprints: []FingerprintEntry{e},
+			Detail: fmt.Sprintf("generated by Debian's broken OpenSSL (CVE-2008-0166): listed in %s:%d", e.SourceFile, e.SourceLine)})
 	}
-	if dups := ctx.GetDuplicatesOf(k); len(dups) != 0 {
-		p := PubKeyProblem{ProblemType: DuplicateKey, ProblemKey: k, RelatedKeys: append(dups, k)}
-		return true, p
+	if IsROCAVulnerable(k.Key) {
+		problems = append(problems, PubKeyProblem{ProblemType: KeyROCAVulnerable, ProblemKey: k,
+			Detail: "RSA modulus has the structure of keys from Infineon's vulnerable library (ROCA, CVE-2017-15361), so it can be factored"})
 	}
-	return false, PubKeyProblem{}
+	problems = append(problems, ctx.CheckCertificates(k)...)
+	problems = append(problems, ctx.CheckOptionRules(k)...)
+	problems = append(problems, ctx.CheckFromOption(k)...)
+	return len(problems) != 0, problems
 }
 
-// IsKeyPermitted returns whether the public key in k is one allowed to be anywhere.
+// IsKeyPermitted returns whether the public key in k is one allowed to be anywhere, or allowed for k's owner
+//  by an unexpired sharing exemption.
 func (ctx *ScanContext) IsKeyPermitted(k OwnedPubKey) bool {
-	return IsKeyInSlice(k, ctx.PermittedKeys)
+	return ctx.IsSharingPermitted(k.Key, []string{k.Owner})
+}
+
+// IsSharingPermitted returns whether a key may be shared by all of owners: it's allowed to be anywhere, by key or fingerprint,
+//  or a single unexpired sharing exemption covers all of them.
+func (ctx *ScanContext) IsSharingPermitted(k ssh.PublicKey, owners []string) bool {
+	if ctx.isPermittedForAnyone(k) {
+		return true
+	}
+	_, ok := ctx.activeExemptionCovering(k, owners)
+	return ok
 }
 
-// IsKeyForbidden returns whether the public key in k is one forbidden from use by anyone.
+// isPermittedForAnyone returns whether a key is in the permitted key files, by key or fingerprint, rather than
+//  only covered by a sharing exemption.
+func (ctx *ScanContext) isPermittedForAnyone(k ssh.PublicKey) bool {
+	return ctx.permittedIndex.Contains(OwnedPubKey{Key: k}) || ctx.permittedFPIndex.Contains(k)
+}
+
+// IsKeyForbidden returns whether the public key in k is one forbidden from use by anyone, by key or fingerprint,
+//  or revoked by a KRL.
 func (ctx *ScanContext) IsKeyForbidden(k OwnedPubKey) bool {
-	return IsKeyInSlice(k, ctx.ForbiddenKeys)
+	return ctx.forbiddenIndex.Contains(k) || ctx.forbiddenFPIndex.Contains(k.Key) || len(ctx.FindRevocations(k)) != 0
 }
 
 // FindKeysForbidding returns the actual entries in forbiddenkeys that will cause a key to be marked as forbidden.
-// There's almost certainly some further abstraction that would remove redundancy around this file but I'm real tired.
 func (ctx *ScanContext) FindKeysForbidding(k OwnedPubKey) []OwnedPubKey {
 	results := make([]OwnedPubKey, 0)
-	for _, opk := range ctx.ForbiddenKeys {
-		if k.HasSameKeyAs(opk) {
-			results = append(results, opk)
+	return append(results, ctx.forbiddenIndex.Lookup(k)...)
+}
+
+// FindRevocations returns how each KRL that revokes k's key does it, e.g. "revoked by /etc/ssh/revoked_keys (explicitly revoked)".
+func (ctx *ScanContext) FindRevocations(k OwnedPubKey) []string {
+	revocations := make([]string, 0)
+	for _, krl := range ctx.RevocationLists {
+		if how, ok := krl.Revokes(k.Key); ok {
+			revocations = append(revocations, fmt.Sprintf("revoked by %s (%s)", krl.SourceFile, how))
 		}
 	}
-	return results
+	return revocations
+}
+
+// FindFingerprintsForbidding returns the fingerprint entries in the forbidden key files that will cause a key to be
+//  marked as forbidden, if there are any.
+func (ctx *ScanContext) FindFingerprintsForbidding(k OwnedPubKey) []FingerprintEntry {
+	return ctx.forbiddenFPIndex.Lookup(k.Key)
 }
 
 // GetDuplicatesOf finds and returns duplicates of an OwnedPubKey k in the ScanContext's FoundKeys.
 func (ctx *ScanContext) GetDuplicatesOf(k OwnedPubKey) []OwnedPubKey {
 	results := make([]OwnedPubKey, 0)
-	for _, opk := range ctx.FoundKeys {
-		if k.HasSameKeyAs(opk) {
-			// Skip any opk that comes from the same source.
-			if k.SourceFile != opk.SourceFile {
-				results = append(results, opk)
-			}
+	for _, opk := range ctx.foundIndex.Lookup(k) {
+		// Skip any opk that comes from the same source.
+		if k.SourceFile != opk.SourceFile {
+			results = append(results, opk)
 		}
 	}
 	return results
 }
 
-// ShouldIgnoreOwner returns true if the ScanContext's Params are set to ignore the user passed.
+// ShouldIgnoreOwner returns true if the ScanContext's Params are set to ignore the user passed, by name,
+//  uid or group.
+// A user that can't be looked up is recorded as an error, once.
 func (ctx *ScanContext) ShouldIgnoreOwner(s string) bool {
-	return ctx.Params.ShouldIgnoreOwner(s)
+	ignore, err := ctx.Params.ShouldIgnoreOwner(ctx.userDirectory(), s)
+	if err != nil {
+		ctx.recordOwnerLookupError(s, err)
+	}
+	return ignore || ctx.excludedByGroup(s)
 }
 
-// ShouldIgnoreOwner returns true if the ScanParams are set to ignore the user passed.
-func (sp *ScanParams) ShouldIgnoreOwner(s string) bool {
-	if stringInStringSlice(s, sp.IgnoredOwners) {
-		return true
+// ShouldIgnoreUser is ShouldIgnoreOwner for when the user's uid is already known.
+func (ctx *ScanContext) ShouldIgnoreUser(name string, uid int) bool {
+	return ctx.Params.ShouldIgnoreUser(name, uid) || ctx.excludedByGroup(name)
+}
+
+// recordOwnerLookupError records that a user couldn't be looked up, unless that's already been recorded for them.
+func (ctx *ScanContext) recordOwnerLookupError(name string, err error) {
+	if ctx.failedOwnerLookups[name] {
+		return
 	}
-	if UIDForUserIsBelow(sp.LowerUIDBound, s) {
-		return true
+	if ctx.failedOwnerLookups == nil {
+		ctx.failedOwnerLookups = make(map[string]bool)
 	}
-	return false
+	ctx.failedOwnerLookups[name] = true
+	ctx.recordScanErrors(ScanError{User: name, Stage: StageOwnerLookup, Err: err})
 }
 
-func UIDForUserIsBelow(lb int, username string) bool {
-	uid, err := getUIDForUser(username)
-	if err != nil {
-		log.Error(err)
-		return false // There's not much we can do in the case of error, so... return false? HACK
-	}
-	if uid < lb {
-		return true
+// ShouldIgnoreOwner returns true if the ScanParams are set to ignore the user passed, looking up their uid in dir.
+// If their uid can't be looked up, they aren't ignored, since they might not be in an ignored range,
+//  and the error is returned so that it isn't missed.
+func (sp *ScanParams) ShouldIgnoreOwner(dir UserDirectory, s string) (bool, error) {
+	if stringInStringSlice(s, sp.IgnoredOwners) {
+		return true, nil
 	}
-	return false
+	r, ok, err := sp.UIDRangeForUser(dir, s)
+	return ok && r.Action == UIDRangeIgnore, err
+}
+
+// ShouldIgnoreUser is ShouldIgnoreOwner for when the user's uid is already known.
+// Groups aren't checked here, since that needs a user directory: see ScanContext.ShouldIgnoreUser.
+func (sp *ScanParams) ShouldIgnoreUser(name string, uid int) bool {
+	return stringInStringSlice(name, sp.IgnoredOwners) || sp.uidIgnored(uid)
 }
 
 // Returns true if the exact string is an element in the string slice.
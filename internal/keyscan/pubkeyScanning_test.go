@@ -0,0 +1,33 @@
+package keyscan
+
+import (
+	"testing"
+)
+
+func TestForbiddenKeyPermission(t *testing.T) {
+	k := testKey(t, 1)
+	alice := OwnedPubKey{Owner: "alice", Key: k, SourceFile: "/home/alice/.ssh/authorized_keys", SourceLine: 1}
+	forbiddenFor := func(ctx *ScanContext) bool {
+		ctx.FoundKeys = []OwnedPubKey{alice}
+		ctx.ForbiddenKeys = []OwnedPubKey{{Key: k}}
+		ctx.ScanKeysForProblems()
+		return len(ctx.Problems.ForbiddenKeys) != 0
+	}
+
+	if !forbiddenFor(&ScanContext{}) {
+		t.Error("forbidden key wasn't reported")
+	}
+	if forbiddenFor(&ScanContext{PermittedKeys: []OwnedPubKey{{Key: k}}}) {
+		t.Error("forbidden key in the permitted key files was reported")
+	}
+	if forbiddenFor(&ScanContext{PermittedFingerprints: []FingerprintEntry{{Fingerprint: KeyFingerprint(k)}}}) {
+		t.Error("forbidden key with a permitted fingerprint was reported")
+	}
+	// A sharing exemption only lets a key be shared; it doesn't stop it being forbidden, even for its users.
+	for _, users := range [][]string{{"alice"}, nil} {
+		ctx := &ScanContext{SharingExemptions: []SharingExemption{{Fingerprint: KeyFingerprint(k), Users: users}}}
+		if !forbiddenFor(ctx) {
+			t.Errorf("forbidden key with a sharing exemption for %v wasn't reported", users)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package keyscan
+
+import (
+	"crypto/rsa"
+	"math/big"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RSA keys made by the Infineon library behind ROCA (CVE-2017-15361), e.g. on YubiKey 4 PIV and many TPMs,
+//  have primes of the form k*M + (65537^a mod M), where M is the product of the first few hundred primes.
+// So, for every small prime p, the modulus mod p is a power of 65537 mod p. A random modulus only manages
+//  that for all of the primes below about once in 240 million, which is good enough for the original
+//  researchers' detector, and this is the same test. It needs nothing but the public key.
+
+// rocaPrimes are the primes the test uses: the ones that divide M for every key size the library makes.
+var rocaPrimes = []int64{3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53, 59, 61, 67, 71, 73, 79,
+	83, 89, 97, 101, 103, 107, 109, 113, 127, 131, 137, 139, 149, 151, 157, 163, 167}
+
+// rocaResidues has, for each of rocaPrimes, bit r set for every power r of 65537 mod that prime.
+var rocaResidues = makeROCAResidues()
+
+func makeROCAResidues() []*big.Int {
+	residues := make([]*big.Int, len(rocaPrimes))
+	for i, p := range rocaPrimes {
+		residues[i] = new(big.Int)
+		g := 65537 % p
+		for r := g; residues[i].Bit(int(r)) == 0; r = (r * g) % p {
+			residues[i].SetBit(residues[i], int(r), 1)
+		}
+	}
+	return residues
+}
+
+// IsROCAVulnerable returns true if k is an RSA key (or a certificate for one) whose modulus has the structure
+//  of the keys affected by ROCA, meaning it can be factored.
+func IsROCAVulnerable(k ssh.PublicKey) bool {
+	if cert, ok := k.(*ssh.Certificate); ok {
+		k = cert.Key
+	}
+	cpk, ok := k.(ssh.CryptoPublicKey)
+	if !ok {
+		return false
+	}
+	rsaKey, ok := cpk.CryptoPublicKey().(*rsa.PublicKey)
+	if !ok {
+		return false
+	}
+	return isROCAModulus(rsaKey.N)
+}
+
+func isROCAModulus(n *big.Int) bool {
+	p, r := new(big.Int), new(big.Int)
+	for i, prime := range rocaPrimes {
+		r.Mod(n, p.SetInt64(prime))
+		if rocaResidues[i].Bit(int(r.Int64())) == 0 {
+			return false
+		}
+	}
+	return true
+}
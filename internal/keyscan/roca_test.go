@@ -0,0 +1,88 @@
+package keyscan
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// rocaTestKey is the key gen-test-files.sh puts in the test files as a ROCA-vulnerable one. Its primes were built
+//  the way Infineon's library builds them.
+const rocaTestKey = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQDHXvnFYrsm7/cw+xGHl7c2vnRNvZG1tJNAM9U/SdpZRO20Dl59NTvOU9gSASMZYJjCAZPm86x6vBgLe5BurEO8eZGwdImugX/d7VwShojchexwXo8x3tdHWWBPebWu7/QVZIhIFkXh+L4p90vDsB2z+g53dzua4beOPS9aVRTPiduoX2BkvzVlwKvpnYeuSq8Tbb5oCigpDMntYpeaekBkdJlwKHS2NHsEdUTjN94+hr/ra5rYNuwyrE0Km94hKs0sWP2XPeaD6fVd5PZmQiHRn+BwHH9uP5khTPKrRgFwsSwrDtjZHpl5HisXFbMRd5X5gtTo6pT7rgrpHtPPMlcV"
+
+// rocaStructuredPrime returns k*M + (65537^a mod M), where M is the product of rocaPrimes: the form of the
+//  primes in vulnerable keys. It isn't necessarily prime, but the test only looks at residues.
+func rocaStructuredPrime(k, a int64) *big.Int {
+	m := big.NewInt(1)
+	for _, p := range rocaPrimes {
+		m.Mul(m, big.NewInt(p))
+	}
+	r := new(big.Int).Exp(big.NewInt(65537), big.NewInt(a), m)
+	return r.Add(r, new(big.Int).Mul(big.NewInt(k), m))
+}
+
+func TestIsROCAVulnerable(t *testing.T) {
+	k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(rocaTestKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsROCAVulnerable(k) {
+		t.Error("the ROCA test key wasn't detected")
+	}
+
+	for _, ab := range [][2]int64{{1, 1}, {17, 4242}, {123456, 99}} {
+		n := new(big.Int).Mul(rocaStructuredPrime(1<<40+ab[0], ab[0]), rocaStructuredPrime(1<<41+ab[1], ab[1]))
+		if !isROCAModulus(n) {
+			t.Errorf("modulus from exponents %d and %d wasn't detected", ab[0], ab[1])
+		}
+		if isROCAModulus(new(big.Int).Add(n, big.NewInt(2))) {
+			t.Errorf("modulus from exponents %d and %d, plus 2, was detected", ab[0], ab[1])
+		}
+	}
+}
+
+func TestIsROCAVulnerableCertificate(t *testing.T) {
+	k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(rocaTestKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsROCAVulnerable(&ssh.Certificate{Key: k}) {
+		t.Error("a certificate for the ROCA test key wasn't detected")
+	}
+}
+
+func TestIsROCAVulnerableGeneratedKeys(t *testing.T) {
+	for i := 0; i < 8; i++ {
+		priv, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, err := ssh.NewPublicKey(&priv.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if IsROCAVulnerable(k) {
+			t.Errorf("freshly generated RSA key detected as ROCA-vulnerable: %s", ssh.MarshalAuthorizedKey(k))
+		}
+	}
+
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := ssh.NewPublicKey(&ec.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsROCAVulnerable(k) {
+		t.Error("ECDSA key detected as ROCA-vulnerable")
+	}
+	if IsROCAVulnerable(testKey(t, 1)) {
+		t.Error("ed25519 key detected as ROCA-vulnerable")
+	}
+}
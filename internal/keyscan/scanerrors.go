@@ -0,0 +1,79 @@
+package keyscan
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// ScanStage names the step of gathering keys that an error happened in.
+type ScanStage string
+
+const (
+	StageGlob        ScanStage = "glob"         // Expanding a glob into paths
+	StageStat        ScanStage = "stat"         // Finding out who owns a file
+	StageOwnerLookup ScanStage = "owner lookup" // Turning a uid into a username or back again
+	StageHome        ScanStage = "home"         // Looking in a user's home directory
+	StageRead        ScanStage = "read"         // Reading a file's contents
+	StageParse       ScanStage = "parse"        // Making sense of a file's contents as a whole
+)
+
+// A ScanError is something that went wrong while gathering keys, which means some keys may have been missed.
+type ScanError struct {
+	Path  string    // The file or glob involved, if there was one
+	User  string    // The user involved, if there was one
+	Stage ScanStage // What we were trying to do
+	Err   error
+}
+
+func (e *ScanError) Error() string {
+	switch {
+	case e.Path != "":
+		return fmt.Sprintf("%s %s: %v", e.Stage, e.Path, e.Err)
+	case e.User != "":
+		return fmt.Sprintf("%s for user %s: %v", e.Stage, e.User, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+// Unwrap returns the underlying error, so errors.Is and errors.As can see through a ScanError.
+func (e *ScanError) Unwrap() error {
+	return e.Err
+}
+
+// MarshalJSON writes a ScanError out with the error as text.
+func (e ScanError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Path  string    `json:"path,omitempty"`
+		User  string    `json:"user,omitempty"`
+		Stage ScanStage `json:"stage"`
+		Error string    `json:"error"`
+	}{e.Path, e.User, e.Stage, e.Err.Error()})
+}
+
+// newFileScanError wraps an error about a file, dropping the os package's own copy of the path.
+func newFileScanError(path string, stage ScanStage, err error) *ScanError {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return &ScanError{Path: path, Stage: stage, Err: err}
+}
+
+// asScanError makes sure err is a ScanError, assuming anything that isn't already happened at stage.
+func asScanError(err error, path string, stage ScanStage) ScanError {
+	if se, ok := err.(*ScanError); ok {
+		return *se
+	}
+	return ScanError{Path: path, Stage: stage, Err: err}
+}
+
+// ScanCoverage summarises how much of what a scan was pointed at it actually managed to check.
+// It only counts the files being scanned, not the permitted and forbidden key lists.
+type ScanCoverage struct {
+	FilesMatched int `json:"files_matched"` // Files the globs expanded to (or that were given directly)
+	FilesRead    int `json:"files_read"`    // Of those, the ones that could be read
+	FilesParsed  int `json:"files_parsed"`  // Of those, the ones where every line parsed
+	KeysFound    int `json:"keys_found"`    // Keys found across all files read
+	UsersChecked int `json:"users_checked"` // Users from the user source whose key files were looked for
+	UsersSkipped int `json:"users_skipped"` // Users from the user source skipped for having a nologin shell, or for being outside the scanned groups
+}
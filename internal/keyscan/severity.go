@@ -0,0 +1,100 @@
+package keyscan
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Severity ranks how urgently a class of problem needs dealing with, so that callers can choose
+//  which problems should count as a failed scan.
+type Severity uint
+
+const (
+	SeverityNone Severity = iota
+	SeverityLow
+	SeverityMedium
+	SeverityHigh
+	SeverityCritical
+)
+
+var severityTexts = []string{"none", "low", "medium", "high", "critical"}
+
+// String returns the lowercase name of a severity, as used in config files and flags.
+func (s Severity) String() string {
+	return severityTexts[uint(s)]
+}
+
+// MarshalJSON writes severities out by name.
+func (s Severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// ParseSeverity turns a severity name (low, medium, high or critical) into a Severity.
+func ParseSeverity(name string) (Severity, error) {
+	for i, v := range severityTexts {
+		if strings.EqualFold(name, v) && i != int(SeverityNone) {
+			return Severity(i), nil
+		}
+	}
+	return SeverityNone, fmt.Errorf("invalid severity %q: must be one of low, medium, high, critical", name)
+}
+
+// GetProblemTypeSeverity gets the severity of a numeric problem class ID.
+func GetProblemTypeSeverity(pt PKProblemType) Severity {
+	switch pt {
+	case KeyForbidden, SharedFactor:
+		return SeverityCritical
+	case KeyTypeDeprecated, KeyTooSmall, UnapprovedCertAuthority, WeakKeyKnownCompromised, KeyROCAVulnerable:
+		return SeverityHigh
+	case DuplicateKey, ECDSACurveNotAllowed, KeyTypeNotAllowed, OwnershipMismatch, OptionMissing, OptionForbidden, SharedKeyOptionMissing,
+		FromPatternTooBroad, FromPatternNotAllowed:
+		return SeverityMedium
+	case MalformedEntry, ExpiredExemption, CertificateExpired, FromPatternInvalid:
+		return SeverityLow
+	}
+	return SeverityNone
+}
+
+// ProblemTypes returns the type of every problem in the set, once per problem.
+func (ps *ProblemSet) ProblemTypes() []PKProblemType {
+	types := make([]PKProblemType, 0)
+	for _, p := range ps.ForbiddenKeys {
+		types = append(types, p.ProblemType)
+	}
+	for _, p := range ps.DuplicateClusters {
+		types = append(types, p.ProblemType)
+	}
+	for _, p := range ps.MalformedEntries {
+		types = append(types, p.ProblemType)
+	}
+	for _, p := range ps.WeakKeys {
+		types = append(types, p.ProblemType)
+	}
+	for _, p := range ps.OwnershipMismatches {
+		types = append(types, p.ProblemType)
+	}
+	for _, p := range ps.ExpiredExemptions {
+		types = append(types, p.ProblemType)
+	}
+	for _, p := range ps.CertificateProblems {
+		types = append(types, p.ProblemType)
+	}
+	for _, p := range ps.SharedFactors {
+		types = append(types, p.ProblemType)
+	}
+	for _, p := range ps.OptionProblems {
+		types = append(types, p.ProblemType)
+	}
+	return types
+}
+
+// AnyAtOrAbove returns true if the set contains a problem with at least the given severity.
+func (ps *ProblemSet) AnyAtOrAbove(threshold Severity) bool {
+	for _, pt := range ps.ProblemTypes() {
+		if GetProblemTypeSeverity(pt) >= threshold {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+package keyscan
+
+import (
+	"crypto/rsa"
+	"math/big"
+	"runtime"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Two RSA keys made by a generator short of entropy, e.g. on an embedded device just after boot, can end up
+//  with one prime in common, and then both are factored by taking the GCD of their moduli.
+// Comparing every pair of keys would take far too long on a big system, so this uses Bernstein's batch GCD:
+//  multiply all the moduli together up a product tree, then reduce the product back down a remainder tree,
+//  so that each modulus n ends up with P mod n², and gcd((P mod n²)/n, n) is the product of n's primes that
+//  some other modulus shares. That takes a few seconds for tens of thousands of keys.
+// The factors themselves would be the private keys, so they're never logged or reported.
+
+// A SharedFactorGroup is a set of distinct RSA keys whose moduli are linked by prime factors they share,
+//  so that every one of them can be factored.
+type SharedFactorGroup struct {
+	ProblemType PKProblemType     `json:"problem_type"`
+	Keys        []SharedFactorKey `json:"keys"` // Each distinct key in the group, in the order found
+}
+
+// A SharedFactorKey is one of the keys in a SharedFactorGroup, along with every place it was found.
+type SharedFactorKey struct {
+	Fingerprint string          `json:"fingerprint"` // SHA256 fingerprint of the key
+	Key         KeyDescription  `json:"key"`
+	Occurrences []KeyOccurrence `json:"occurrences"` // Each distinct owner, file and line the key was found at
+}
+
+// ScanForSharedFactors runs the batch GCD over the found keys if the scan params ask for it, adds any
+//  groups of keys with shared factors to the context's problems, and returns true if there were any.
+// It should be run after ScanKeysForProblems.
+func (ctx *ScanContext) ScanForSharedFactors() bool {
+	if !ctx.Params.SharedFactorAnalysis {
+		return false
+	}
+	ctx.Problems.SharedFactors = ctx.FindSharedFactors()
+	return len(ctx.Problems.SharedFactors) != 0
+}
+
+// FindSharedFactors returns a group for each set of found RSA keys (or certificates for them) linked by shared
+//  prime factors, unless every owner of every key in it is ignored.
+// Keys with the same modulus are duplicates rather than this, so they're treated as one key.
+func (ctx *ScanContext) FindSharedFactors() []SharedFactorGroup {
+	groups := make([]SharedFactorGroup, 0)
+
+	moduli := make([]*big.Int, 0)
+	keysByModulus := make([][]OwnedPubKey, 0)
+	seen := make(map[string]int)
+	for _, k := range ctx.FoundKeys {
+		n := rsaModulus(k.Key)
+		if n == nil {
+			continue
+		}
+		i, ok := seen[string(n.Bytes())]
+		if !ok {
+			i = len(moduli)
+			seen[string(n.Bytes())] = i
+			moduli = append(moduli, n)
+			keysByModulus = append(keysByModulus, nil)
+		}
+		keysByModulus[i] = append(keysByModulus[i], k)
+	}
+
+	start := time.Now()
+	sharing := batchGCD(moduli)
+	log.WithFields(log.Fields{"moduli": len(moduli), "sharing": len(sharing), "seconds": time.Since(start).Seconds()}).Info("Shared factor analysis complete")
+
+	for _, members := range linkedModuli(moduli, sharing) {
+		g := SharedFactorGroup{ProblemType: SharedFactor, Keys: make([]SharedFactorKey, 0, len(members))}
+		allIgnored := true
+		for _, i := range members {
+			c := NewDuplicateCluster(keysByModulus[i])
+			g.Keys = append(g.Keys, SharedFactorKey{Fingerprint: c.Fingerprint, Key: c.Key, Occurrences: c.Occurrences})
+			allIgnored = allIgnored && ctx.allOwnersIgnored(c.Occurrences)
+		}
+		if allIgnored {
+			continue
+		}
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// rsaModulus returns the modulus of an RSA key, or of the key an RSA certificate certifies, or nil for any other key.
+func rsaModulus(k ssh.PublicKey) *big.Int {
+	if cert, ok := k.(*ssh.Certificate); ok {
+		k = cert.Key
+	}
+	cpk, ok := k.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil
+	}
+	rsaKey, ok := cpk.CryptoPublicKey().(*rsa.PublicKey)
+	if !ok {
+		return nil
+	}
+	return rsaKey.N
+}
+
+// batchGCD returns the indexes of the moduli that share a prime factor with at least one of the others.
+// The moduli must be distinct.
+func batchGCD(moduli []*big.Int) []int {
+	sharing := make([]int, 0)
+	if len(moduli) < 2 {
+		return sharing
+	}
+
+	// tree[0] is the moduli, and each level above holds the products of pairs from the one below,
+	//  up to the product of everything at the top.
+	tree := [][]*big.Int{moduli}
+	for level := moduli; len(level) > 1; {
+		next := make([]*big.Int, (len(level)+1)/2)
+		parallelFor(len(next), func(i int) {
+			if 2*i+1 < len(level) {
+				next[i] = new(big.Int).Mul(level[2*i], level[2*i+1])
+			} else {
+				next[i] = level[2*i]
+			}
+		})
+		tree = append(tree, next)
+		level = next
+	}
+
+	// Then back down, reducing each node's remainder modulo the square of each of its children.
+	rems := tree[len(tree)-1]
+	for l := len(tree) - 2; l >= 0; l-- {
+		level, parents := tree[l], rems
+		next := make([]*big.Int, len(level))
+		parallelFor(len(level), func(i int) {
+			sq := new(big.Int).Mul(level[i], level[i])
+			next[i] = new(big.Int).Mod(parents[i/2], sq)
+		})
+		rems = next
+		tree[l+1] = nil
+	}
+
+	one := big.NewInt(1)
+	for i, n := range moduli {
+		q := new(big.Int).Quo(rems[i], n)
+		if q.GCD(nil, nil, q, n).Cmp(one) != 0 {
+			sharing = append(sharing, i)
+		}
+	}
+	return sharing
+}
+
+// linkedModuli splits the moduli at the given indexes into groups, each linked by shared factors, in the
+//  order of their first members.
+// Only the moduli batchGCD picked out can share a factor, so it's enough to compare each pair of those.
+func linkedModuli(moduli []*big.Int, sharing []int) [][]int {
+	parent := make([]int, len(sharing))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	one := big.NewInt(1)
+	g := new(big.Int)
+	for a := range sharing {
+		for b := a + 1; b < len(sharing); b++ {
+			if g.GCD(nil, nil, moduli[sharing[a]], moduli[sharing[b]]).Cmp(one) != 0 {
+				if ra, rb := find(a), find(b); ra < rb {
+					parent[rb] = ra
+				} else {
+					parent[ra] = rb
+				}
+			}
+		}
+	}
+
+	groups := make([][]int, 0)
+	groupOf := make(map[int]int)
+	for a, i := range sharing {
+		root := find(a)
+		if g, ok := groupOf[root]; ok {
+			groups[g] = append(groups[g], i)
+			continue
+		}
+		groupOf[root] = len(groups)
+		groups = append(groups, []int{i})
+	}
+	return groups
+}
+
+// parallelFor calls f for each of 0 to n-1, spread over as many goroutines as there are CPUs.
+func parallelFor(n int, f func(i int)) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU() && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
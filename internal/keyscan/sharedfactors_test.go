@@ -0,0 +1,87 @@
+package keyscan
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+// Small primes stand in for the real thing: batchGCD and linkedModuli don't care how big they are.
+var testPrimes = []int64{1000003, 1000033, 1000037, 1000039, 1000081, 1000099, 1000117, 1000121, 1000133, 1000151}
+
+// testModulus multiplies together the test primes at the given indexes.
+func testModulus(primes ...int) *big.Int {
+	n := big.NewInt(1)
+	for _, i := range primes {
+		n.Mul(n, big.NewInt(testPrimes[i]))
+	}
+	return n
+}
+
+func TestBatchGCD(t *testing.T) {
+	tests := []struct {
+		name    string
+		moduli  []*big.Int
+		sharing []int
+		groups  [][]int
+	}{
+		{
+			name:    "none",
+			moduli:  []*big.Int{},
+			sharing: []int{},
+			groups:  [][]int{},
+		},
+		{
+			name:    "one",
+			moduli:  []*big.Int{testModulus(0, 1)},
+			sharing: []int{},
+			groups:  [][]int{},
+		},
+		{
+			name:    "unrelated",
+			moduli:  []*big.Int{testModulus(0, 1), testModulus(2, 3), testModulus(4, 5), testModulus(6, 7), testModulus(8, 9)},
+			sharing: []int{},
+			groups:  [][]int{},
+		},
+		{
+			name:    "two sharing a prime",
+			moduli:  []*big.Int{testModulus(0, 1), testModulus(2, 3), testModulus(0, 4)},
+			sharing: []int{0, 2},
+			groups:  [][]int{{0, 2}},
+		},
+		{
+			name:    "chain",
+			moduli:  []*big.Int{testModulus(0, 1), testModulus(1, 2), testModulus(8, 9), testModulus(2, 3)},
+			sharing: []int{0, 1, 3},
+			groups:  [][]int{{0, 1, 3}},
+		},
+		{
+			name:    "both primes shared, with different moduli",
+			moduli:  []*big.Int{testModulus(4, 5), testModulus(0, 1), testModulus(0, 2), testModulus(1, 3)},
+			sharing: []int{1, 2, 3},
+			groups:  [][]int{{1, 2, 3}},
+		},
+		{
+			name:    "two separate groups",
+			moduli:  []*big.Int{testModulus(0, 1), testModulus(2, 3), testModulus(0, 4), testModulus(2, 5), testModulus(6, 7)},
+			sharing: []int{0, 1, 2, 3},
+			groups:  [][]int{{0, 2}, {1, 3}},
+		},
+		{
+			name:    "odd number of moduli",
+			moduli:  []*big.Int{testModulus(0, 1), testModulus(2, 3), testModulus(4, 5), testModulus(6, 7), testModulus(8, 1), testModulus(2, 9), testModulus(4, 6)},
+			sharing: []int{0, 1, 2, 3, 4, 5, 6},
+			groups:  [][]int{{0, 4}, {1, 5}, {2, 3, 6}},
+		},
+	}
+	for _, tt := range tests {
+		sharing := batchGCD(tt.moduli)
+		if !reflect.DeepEqual(sharing, tt.sharing) {
+			t.Errorf("%s: batchGCD = %v, want %v", tt.name, sharing, tt.sharing)
+			continue
+		}
+		if groups := linkedModuli(tt.moduli, sharing); !reflect.DeepEqual(groups, tt.groups) {
+			t.Errorf("%s: linkedModuli = %v, want %v", tt.name, groups, tt.groups)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package keyscan
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultAuthorizedKeysFiles is what sshd reads keys from if AuthorizedKeysFile isn't set.
+var DefaultAuthorizedKeysFiles = []string{".ssh/authorized_keys", ".ssh/authorized_keys2"}
+
+// maxIncludeDepth is as deep as sshd lets Include directives nest.
+const maxIncludeDepth = 16
+
+// sshdConfigDir is where sshd looks for relative Include paths, wherever the config file itself is.
+const sshdConfigDir = "/etc/ssh"
+
+// SSHDConfig is the part of an sshd_config that says where sshd looks for users' keys.
+type SSHDConfig struct {
+	Path               string            // The top-level config file
+	AuthorizedKeysFile []string          // The global setting, or nil if it isn't set
+	MatchBlocks        []*SSHDMatchBlock // Match blocks that set AuthorizedKeysFile, in the order they appear
+}
+
+// An SSHDMatchBlock is a Match block that sets AuthorizedKeysFile.
+type SSHDMatchBlock struct {
+	Criteria           []SSHDMatchCriterion
+	AuthorizedKeysFile []string
+	SourceFile         string
+	SourceLine         int
+}
+
+// An SSHDMatchCriterion is one criterion from a Match line, e.g. User alice,bob
+type SSHDMatchCriterion struct {
+	Keyword  string // Lowercase, e.g. all, user, group, host or address
+	Patterns string // Comma-separated patterns, as given
+}
+
+// ParseSSHDConfig reads an sshd_config file, following any Include directives, and picks out
+//  the AuthorizedKeysFile settings.
+// Relative Include paths are taken relative to /etc/ssh, as sshd does, even if the file is somewhere else.
+// If it runs into a problem part way through, it returns what it got up to along with the error.
+func ParseSSHDConfig(path string) (*SSHDConfig, error) {
+	c := &SSHDConfig{Path: path}
+	p := sshdConfigParser{config: c, baseDir: sshdConfigDir}
+	return c, p.parseFile(path, nil, 0)
+}
+
+type sshdConfigParser struct {
+	config  *SSHDConfig
+	baseDir string // For relative Include paths
+}
+
+// parseFile reads one config file. block is the Match block in force where the file was included,
+//  or nil for the global section. As in sshd, a Match in an included file only lasts until the end of that file.
+func (p *sshdConfigParser) parseFile(path string, block *SSHDMatchBlock, depth int) error {
+	if depth > maxIncludeDepth {
+		return &ScanError{Path: path, Stage: StageParse, Err: errors.New("Include directives nested too deeply")}
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return newFileScanError(path, StageRead, err)
+	}
+
+	for i, line := range strings.Split(string(contents), "\n") {
+		parseError := func(err error) error {
+			return &ScanError{Path: path, Stage: StageParse, Err: fmt.Errorf("line %d: %v", i+1, err)}
+		}
+		args, err := splitSSHDConfigLine(line)
+		if err != nil {
+			return parseError(err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		switch strings.ToLower(args[0]) {
+		case "match":
+			criteria, err := parseMatchCriteria(args[1:])
+			if err != nil {
+				return parseError(err)
+			}
+			for _, c := range criteria {
+				if !knownMatchCriteria[c.Keyword] {
+					log.WithFields(log.Fields{"file": path, "line": i + 1, "criterion": c.Keyword}).Warn("Unsupported Match criterion: assuming the block might apply to anyone")
+				}
+			}
+			block = &SSHDMatchBlock{Criteria: criteria, SourceFile: path, SourceLine: i + 1}
+		case "include":
+			if len(args) < 2 {
+				return parseError(errors.New("Include needs at least one file"))
+			}
+			for _, pattern := range args[1:] {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(p.baseDir, pattern)
+				}
+				matches, err := filepath.Glob(pattern) // Sorted, as sshd reads them
+				if err != nil {
+					return parseError(fmt.Errorf("bad Include pattern %q: %v", pattern, err))
+				}
+				for _, m := range matches {
+					if err := p.parseFile(m, block, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+		case "authorizedkeysfile":
+			if len(args) < 2 {
+				return parseError(errors.New("AuthorizedKeysFile needs at least one file"))
+			}
+			// For sshd, the first value given for a setting is the one that sticks.
+			if block == nil {
+				if p.config.AuthorizedKeysFile == nil {
+					p.config.AuthorizedKeysFile = args[1:]
+				}
+			} else if block.AuthorizedKeysFile == nil {
+				block.AuthorizedKeysFile = args[1:]
+				p.config.MatchBlocks = append(p.config.MatchBlocks, block)
+			}
+		}
+	}
+	return nil
+}
+
+// splitSSHDConfigLine splits a config line into its keyword and arguments.
+// The keyword can be followed by whitespace or an =, arguments can be double-quoted,
+//  and anything from an unquoted # at the start of an argument onwards is a comment.
+func splitSSHDConfigLine(line string) ([]string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end == -1 {
+		return []string{line}, nil
+	}
+	args := []string{line[:end]}
+	rest := strings.TrimLeft(line[end:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = rest[1:]
+	}
+
+	var arg strings.Builder
+	inArg, inQuote := false, false
+	for i := 0; i < len(rest); i++ {
+		c := rest[i]
+		switch {
+		case inQuote && c == '"':
+			inQuote = false
+		case inQuote:
+			arg.WriteByte(c)
+		case c == '"':
+			inQuote, inArg = true, true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case c == '#' && !inArg:
+			return args, nil
+		case c == '\\' && i+1 < len(rest):
+			i++
+			arg.WriteByte(rest[i])
+			inArg = true
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inQuote {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// knownMatchCriteria are the Match criteria matchesUser understands. Any others are kept, and the
+//  block is taken as possibly applying to anyone, since newer versions of sshd add criteria.
+var knownMatchCriteria = map[string]bool{
+	"all": true, "user": true, "group": true, "host": true, "address": true, "localaddress": true, "localport": true, "rdomain": true,
+}
+
+// parseMatchCriteria parses the arguments of a Match line.
+// An unknown criterion takes the next argument as its value, if there is one, since most criteria have one.
+func parseMatchCriteria(args []string) ([]SSHDMatchCriterion, error) {
+	if len(args) == 0 {
+		return nil, errors.New("Match needs at least one criterion")
+	}
+	if len(args) == 1 && strings.EqualFold(args[0], "all") {
+		return []SSHDMatchCriterion{{Keyword: "all"}}, nil
+	}
+	criteria := make([]SSHDMatchCriterion, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		keyword := strings.ToLower(args[i])
+		if keyword == "all" {
+			return nil, errors.New("Match all can't be combined with other criteria")
+		}
+		if i+1 >= len(args) {
+			if knownMatchCriteria[keyword] {
+				return nil, fmt.Errorf("Match %s needs a value", args[i])
+			}
+			criteria = append(criteria, SSHDMatchCriterion{Keyword: keyword})
+			break
+		}
+		criteria = append(criteria, SSHDMatchCriterion{Keyword: keyword, Patterns: args[i+1]})
+	}
+	return criteria, nil
+}
+
+type matchResult int
+
+const (
+	matchNo      matchResult = iota
+	matchYes                 // Applies whenever this user logs in
+	matchUnknown             // Might apply, depending on something only known when they connect (e.g. their address)
+)
+
+// matchesUser works out whether a Match block applies to a user.
+// groups is only called if the block has a Group criterion.
+func (b *SSHDMatchBlock) matchesUser(u PasswdEntry, groups func(PasswdEntry) ([]string, error)) matchResult {
+	result := matchYes
+	for _, c := range b.Criteria {
+		switch c.Keyword {
+		case "all":
+		case "user":
+			if !matchPatternList(u.Name, c.Patterns) {
+				return matchNo
+			}
+		case "group":
+			names, err := groups(u)
+			if err != nil {
+				result = matchUnknown
+			} else if !matchGroupPatternList(names, c.Patterns) {
+				return matchNo
+			}
+		default:
+			result = matchUnknown
+		}
+	}
+	return result
+}
+
+// AuthorizedKeysFilesFor returns the files sshd would read keys from when u logs in, with tokens expanded,
+//  in the order sshd would read them.
+// The first Match block that's certain to apply overrides the global setting. A Match block that might or
+//  might not apply, depending on how the user connects, adds its files as well, so nothing sshd might read is missed.
+func (c *SSHDConfig) AuthorizedKeysFilesFor(u PasswdEntry, groups func(PasswdEntry) ([]string, error)) ([]string, error) {
+	patterns := make([]string, 0)
+	settled := false
+	for _, b := range c.MatchBlocks {
+		result := b.matchesUser(u, groups)
+		if result != matchNo {
+			patterns = append(patterns, b.AuthorizedKeysFile...)
+		}
+		if result == matchYes {
+			settled = true
+			break
+		}
+	}
+	if !settled {
+		global := c.AuthorizedKeysFile
+		if global == nil {
+			global = DefaultAuthorizedKeysFiles
+		}
+		patterns = append(patterns, global...)
+	}
+
+	paths := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if strings.EqualFold(pattern, "none") {
+			continue
+		}
+		path, err := expandAuthorizedKeysFile(pattern, u)
+		if err != nil {
+			return paths, err
+		}
+		if !stringInStringSlice(path, paths) {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// expandAuthorizedKeysFile expands the tokens sshd allows in AuthorizedKeysFile (%% %h %u %U) for a user.
+// Relative paths are taken relative to the user's home directory.
+func expandAuthorizedKeysFile(pattern string, u PasswdEntry) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			b.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		if i == len(pattern) {
+			return "", fmt.Errorf("AuthorizedKeysFile %q ends with a lone %%", pattern)
+		}
+		switch pattern[i] {
+		case '%':
+			b.WriteByte('%')
+		case 'h':
+			b.WriteString(u.Home)
+		case 'u':
+			b.WriteString(u.Name)
+		case 'U':
+			b.WriteString(strconv.Itoa(u.UID))
+		default:
+			return "", fmt.Errorf("AuthorizedKeysFile %q has unknown token %%%c", pattern, pattern[i])
+		}
+	}
+	path := b.String()
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(u.Home, path)
+	}
+	return filepath.Clean(path), nil
+}
+
+// matchPatternList matches s against a comma-separated list of patterns as sshd does:
+//  if a pattern starting with ! matches, that's a definite no, otherwise any other pattern matching is a yes.
+func matchPatternList(s, list string) bool {
+	matched := false
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		}
+		if matchPattern(s, pattern) {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchGroupPatternList is matchPatternList for a user's groups: a negated match on any of them is a no,
+//  otherwise a match on any of them is a yes.
+func matchGroupPatternList(groups []string, list string) bool {
+	matched := false
+	for _, g := range groups {
+		for _, pattern := range strings.Split(list, ",") {
+			pattern = strings.TrimSpace(pattern)
+			if strings.HasPrefix(pattern, "!") {
+				if matchPattern(g, pattern[1:]) {
+					return false
+				}
+			} else if matchPattern(g, pattern) {
+				matched = true
+			}
+		}
+	}
+	return matched
+}
+
+// matchPattern matches s against a pattern where * matches any run of characters and ? any one character,
+//  which is all the wildcarding sshd does.
+func matchPattern(s, pattern string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(s[i:], pattern[1:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		s = s[1:]
+		pattern = pattern[1:]
+	}
+	return s == ""
+}
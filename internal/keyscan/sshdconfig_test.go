@@ -0,0 +1,271 @@
+package keyscan
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitSSHDConfigLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"   ", nil, false},
+		{"# AuthorizedKeysFile x", nil, false},
+		{"  # indented comment", nil, false},
+		{"PasswordAuthentication", []string{"PasswordAuthentication"}, false},
+		{"AuthorizedKeysFile .ssh/authorized_keys", []string{"AuthorizedKeysFile", ".ssh/authorized_keys"}, false},
+		{"AuthorizedKeysFile\t a  b\t", []string{"AuthorizedKeysFile", "a", "b"}, false},
+		{"AuthorizedKeysFile=a b", []string{"AuthorizedKeysFile", "a", "b"}, false},
+		{"AuthorizedKeysFile = a", []string{"AuthorizedKeysFile", "a"}, false},
+		{`AuthorizedKeysFile "/etc/ssh/keys for/%u" b`, []string{"AuthorizedKeysFile", "/etc/ssh/keys for/%u", "b"}, false},
+		{`AuthorizedKeysFile a"b c"d`, []string{"AuthorizedKeysFile", "ab cd"}, false},
+		{`AuthorizedKeysFile ""`, []string{"AuthorizedKeysFile", ""}, false},
+		{`AuthorizedKeysFile a\ b`, []string{"AuthorizedKeysFile", "a b"}, false},
+		{"AuthorizedKeysFile a # the rest is a comment", []string{"AuthorizedKeysFile", "a"}, false},
+		{"AuthorizedKeysFile a#b", []string{"AuthorizedKeysFile", "a#b"}, false},
+		{`AuthorizedKeysFile "#a"`, []string{"AuthorizedKeysFile", "#a"}, false},
+		{`AuthorizedKeysFile "a`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := splitSSHDConfigLine(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitSSHDConfigLine(%q) error = %v, want error: %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitSSHDConfigLine(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseMatchCriteria(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    []SSHDMatchCriterion
+		wantErr bool
+	}{
+		{[]string{"All"}, []SSHDMatchCriterion{{Keyword: "all"}}, false},
+		{[]string{"User", "alice,bob"}, []SSHDMatchCriterion{{"user", "alice,bob"}}, false},
+		{[]string{"GROUP", "admins", "Address", "10.0.0.0/8"}, []SSHDMatchCriterion{{"group", "admins"}, {"address", "10.0.0.0/8"}}, false},
+		{[]string{"Tagged", "sftp", "User", "alice"}, []SSHDMatchCriterion{{"tagged", "sftp"}, {"user", "alice"}}, false},
+		{[]string{"User", "alice", "Invalid-User"}, []SSHDMatchCriterion{{"user", "alice"}, {Keyword: "invalid-user"}}, false},
+		{nil, nil, true},
+		{[]string{"User"}, nil, true},
+		{[]string{"User", "alice", "Group"}, nil, true},
+		{[]string{"User", "alice", "All"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseMatchCriteria(tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMatchCriteria(%q) error = %v, want error: %v", tt.args, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseMatchCriteria(%q) = %+v, want %+v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestMatchPatternList(t *testing.T) {
+	tests := []struct {
+		s, list string
+		want    bool
+	}{
+		{"alice", "alice", true},
+		{"alice", "bob", false},
+		{"alice", "bob,alice", true},
+		{"alice", "bob, alice", true},
+		{"alice", "a*", true},
+		{"alice", "*", true},
+		{"alice", "al?ce", true},
+		{"alice", "al?e", false},
+		{"alice", "*e", true},
+		{"alice", "a*x", false},
+		{"alice", "Alice", false},
+		{"alice", "*,!alice", false},
+		{"alice", "!alice,*", false},
+		{"bob", "*,!alice", true},
+		{"alice", "!bob", false}, // Only negated patterns never match
+		{"", "*", true},
+		{"", "?", false},
+	}
+	for _, tt := range tests {
+		if got := matchPatternList(tt.s, tt.list); got != tt.want {
+			t.Errorf("matchPatternList(%q, %q) = %v, want %v", tt.s, tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestMatchGroupPatternList(t *testing.T) {
+	tests := []struct {
+		groups []string
+		list   string
+		want   bool
+	}{
+		{[]string{"users", "admins"}, "admins", true},
+		{[]string{"users", "admins"}, "wheel", false},
+		{[]string{"users", "admins"}, "adm*", true},
+		{[]string{"users", "admins"}, "users,!admins", false},
+		{[]string{"users", "admins"}, "!admins,users", false},
+		{[]string{"users"}, "users,!admins", true},
+		{[]string{"users"}, "!admins", false},
+		{nil, "*", false},
+	}
+	for _, tt := range tests {
+		if got := matchGroupPatternList(tt.groups, tt.list); got != tt.want {
+			t.Errorf("matchGroupPatternList(%q, %q) = %v, want %v", tt.groups, tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestExpandAuthorizedKeysFile(t *testing.T) {
+	u := PasswdEntry{Name: "alice", UID: 1000, Home: "/home/alice"}
+	tests := []struct {
+		pattern string
+		want    string
+		wantErr bool
+	}{
+		{".ssh/authorized_keys", "/home/alice/.ssh/authorized_keys", false},
+		{"%h/.ssh/authorized_keys", "/home/alice/.ssh/authorized_keys", false},
+		{"/etc/ssh/keys/%u", "/etc/ssh/keys/alice", false},
+		{"/etc/ssh/keys/%U", "/etc/ssh/keys/1000", false},
+		{"/etc/ssh/keys/%u.%U", "/etc/ssh/keys/alice.1000", false},
+		{"/etc/ssh/100%%/%u", "/etc/ssh/100%/alice", false},
+		{"keys/%u", "/home/alice/keys/alice", false},
+		{"/etc/ssh//keys/./%u", "/etc/ssh/keys/alice", false},
+		{"/etc/ssh/keys/%u%", "", true},
+		{"/etc/ssh/keys/%i", "", true},
+	}
+	for _, tt := range tests {
+		got, err := expandAuthorizedKeysFile(tt.pattern, u)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("expandAuthorizedKeysFile(%q) error = %v, want error: %v", tt.pattern, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandAuthorizedKeysFile(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+// parseTestSSHDConfig writes files into a temporary directory and parses the first, with relative
+//  Include paths taken from that directory rather than /etc/ssh.
+func parseTestSSHDConfig(t *testing.T, files map[string]string, top string) (*SSHDConfig, string, error) {
+	dir, err := ioutil.TempDir("", "keyscan-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &SSHDConfig{Path: filepath.Join(dir, top)}
+	p := sshdConfigParser{config: c, baseDir: dir}
+	return c, dir, p.parseFile(c.Path, nil, 0)
+}
+
+func TestParseSSHDConfig(t *testing.T) {
+	c, dir, err := parseTestSSHDConfig(t, map[string]string{
+		"sshd_config": `
+AuthorizedKeysFile /etc/ssh/keys/%u .ssh/authorized_keys
+AuthorizedKeysFile .ssh/ignored
+Include sshd_config.d/*.conf
+Match User alice
+	AuthorizedKeysFile none
+	AuthorizedKeysFile /ignored
+Match Tagged sftp
+	AuthorizedKeysFile /etc/ssh/sftp/%u
+Match Group admins
+	PasswordAuthentication no
+`,
+		"sshd_config.d/10-admins.conf": "Match Group admins\n\tAuthorizedKeysFile /etc/ssh/admins/%u\n",
+		"sshd_config.d/20-rest.conf":   "AuthorizedKeysFile .ssh/also_ignored\n",
+	}, "sshd_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"/etc/ssh/keys/%u", ".ssh/authorized_keys"}; !reflect.DeepEqual(c.AuthorizedKeysFile, want) {
+		t.Errorf("AuthorizedKeysFile = %q, want the first one set, %q", c.AuthorizedKeysFile, want)
+	}
+	want := []SSHDMatchBlock{
+		{Criteria: []SSHDMatchCriterion{{"group", "admins"}}, AuthorizedKeysFile: []string{"/etc/ssh/admins/%u"},
+			SourceFile: filepath.Join(dir, "sshd_config.d/10-admins.conf"), SourceLine: 1},
+		{Criteria: []SSHDMatchCriterion{{"user", "alice"}}, AuthorizedKeysFile: []string{"none"},
+			SourceFile: filepath.Join(dir, "sshd_config"), SourceLine: 5},
+		{Criteria: []SSHDMatchCriterion{{"tagged", "sftp"}}, AuthorizedKeysFile: []string{"/etc/ssh/sftp/%u"},
+			SourceFile: filepath.Join(dir, "sshd_config"), SourceLine: 8},
+	}
+	got := make([]SSHDMatchBlock, 0, len(c.MatchBlocks))
+	for _, b := range c.MatchBlocks {
+		got = append(got, *b)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MatchBlocks = %+v, want %+v", got, want)
+	}
+
+	groups := func(u PasswdEntry) ([]string, error) {
+		if u.Name == "carol" {
+			return nil, errors.New("directory unavailable")
+		}
+		if u.Name == "bob" {
+			return []string{"users", "admins"}, nil
+		}
+		return []string{"users"}, nil
+	}
+	tests := []struct {
+		user string
+		want []string
+	}{
+		// Only the first block that's sure to apply counts, and none turns the user's keys off.
+		{"alice", []string{}},
+		{"bob", []string{"/etc/ssh/admins/bob"}},
+		// Without groups, any block might apply.
+		{"carol", []string{"/etc/ssh/admins/carol", "/etc/ssh/sftp/carol", "/etc/ssh/keys/carol", "/home/carol/.ssh/authorized_keys"}},
+		{"dave", []string{"/etc/ssh/sftp/dave", "/etc/ssh/keys/dave", "/home/dave/.ssh/authorized_keys"}},
+	}
+	for _, tt := range tests {
+		u := PasswdEntry{Name: tt.user, Home: "/home/" + tt.user}
+		got, err := c.AuthorizedKeysFilesFor(u, groups)
+		if err != nil {
+			t.Errorf("AuthorizedKeysFilesFor(%s): %v", tt.user, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("AuthorizedKeysFilesFor(%s) = %q, want %q", tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestParseSSHDConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{"unterminated quote", "AuthorizedKeysFile \"a\n"},
+		{"empty Match", "Match\n"},
+		{"Match without a value", "Match User\n"},
+		{"empty AuthorizedKeysFile", "AuthorizedKeysFile\n"},
+		{"empty Include", "Include\n"},
+		{"Include loop", "Include sshd_config\n"},
+	}
+	for _, tt := range tests {
+		c, _, err := parseTestSSHDConfig(t, map[string]string{"sshd_config": tt.contents}, "sshd_config")
+		if err == nil {
+			t.Errorf("%s: parsed without an error: %+v", tt.name, c)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package keyscan
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A TargetFile is a file to read keys to scan from.
+type TargetFile struct {
+	Path     string
+	User     string // The account the file grants access to, if known. If not, it's worked out from whose home directory the file is in.
+	UID      int
+	Optional bool // If the file doesn't exist, that's not an error, since sshd doesn't treat it as one either.
+}
+
+// GatherKeysToScan gathers keys from every file the scan params point at: the target globs, and, if a
+//  user source or sshd_config is set, the files sshd would read keys from for each user.
+func (ctx *ScanContext) GatherKeysToScan() {
+	targets := make([]TargetFile, 0)
+	if ctx.Params.UserSource != "" || ctx.Params.SSHDConfigFile != "" {
+		targets = append(targets, ctx.userTargets()...)
+	}
+	targets = append(targets, ctx.globTargets(ctx.Params.TargetGlobs)...)
+	ctx.GatherKeysToScanFromTargets(dedupeTargets(targets))
+}
+
+// GatherKeysToScanFromTargets reads keys from each target, attributing them to the target's user if it has one.
+func (ctx *ScanContext) GatherKeysToScanFromTargets(targets []TargetFile) {
+	paths := make([]string, len(targets))
+	for i, t := range targets {
+		paths[i] = t.Path
+	}
+
+	for i, r := range ctx.gatherKeysFromFiles(paths) {
+		t := targets[i]
+		if t.Optional && r.Err != nil && r.Err.Stage == StageStat && os.IsNotExist(r.Err.Err) {
+			continue
+		}
+		ctx.attributeKeyFileResult(&r, t)
+		ctx.addFileResults([]KeyFileResult{r})
+		ctx.FilesScanned = append(ctx.FilesScanned, t.Path)
+		ctx.Coverage.FilesMatched++
+		if r.Err != nil {
+			continue
+		}
+		ctx.Coverage.FilesRead++
+		if len(r.Malformed) == 0 {
+			ctx.Coverage.FilesParsed++
+		}
+		ctx.Coverage.KeysFound += len(r.Keys)
+		ctx.FoundKeys = appendEachKey(ctx.FoundKeys, r.Keys)
+	}
+}
+
+// globTargets expands globs into targets, which are attributed to whoever owns them.
+func (ctx *ScanContext) globTargets(globs []string) []TargetFile {
+	paths, errs := GetPathsByGlob(globs)
+	ctx.recordScanErrors(errs...)
+	return pathTargets(paths)
+}
+
+func pathTargets(paths []string) []TargetFile {
+	targets := make([]TargetFile, len(paths))
+	for i, p := range paths {
+		targets[i] = TargetFile{Path: p}
+	}
+	return targets
+}
+
+// userTargets works out the files sshd would read keys from for every user from the user source, using
+//  AuthorizedKeysFile from sshd_config if that's set, or sshd's default if not.
+// Each user's home directory is checked on the way: if it's missing or can't be read, that's recorded,
+//  and files inside it aren't looked for.
+// A file that more than one user would read keys from (e.g. AuthorizedKeysFile /etc/ssh/shared_keys)
+//  can't be attributed to any one of them, so it's left for attributeKeyFileResult to work out.
+func (ctx *ScanContext) userTargets() []TargetFile {
+	config := &SSHDConfig{}
+	if ctx.Params.SSHDConfigFile != "" {
+		var err error
+		config, err = ParseSSHDConfig(ctx.Params.SSHDConfigFile)
+		if err != nil {
+			// Whatever was parsed before the error is still used, so at least those files are checked.
+			ctx.recordScanErrors(asScanError(err, ctx.Params.SSHDConfigFile, StageParse))
+		}
+	}
+	users := ctx.passwdUsers()
+	log.WithFields(log.Fields{"sshd_config": ctx.Params.SSHDConfigFile, "users": len(users), "match_blocks": len(config.MatchBlocks)}).Info("Finding key files for each user")
+
+	targets := make([]TargetFile, 0)
+	usersOfPath := make(map[string]int)
+	expansionErrors := make(map[string]bool) // A bad token breaks the same pattern for everyone, so only report it once
+	for _, u := range users {
+		if ctx.Params.SkipNologinUsers && isNologinShell(u.Shell) {
+			log.WithFields(log.Fields{"user": u.Name, "shell": u.Shell}).Debug("Skipping user with nologin shell")
+			ctx.Coverage.UsersSkipped++
+			continue
+		}
+		if !ctx.inScannedGroups(u) {
+			log.WithFields(log.Fields{"user": u.Name}).Debug("Skipping user outside the scanned groups")
+			ctx.Coverage.UsersSkipped++
+			continue
+		}
+		ctx.Coverage.UsersChecked++
+		homeOK := ctx.checkHomeDir(u)
+
+		paths, err := config.AuthorizedKeysFilesFor(u, ctx.userDirectory().GroupNames)
+		if err != nil && !expansionErrors[err.Error()] {
+			expansionErrors[err.Error()] = true
+			ctx.recordScanErrors(ScanError{Path: ctx.Params.SSHDConfigFile, Stage: StageParse, Err: err})
+		}
+		for _, p := range paths {
+			if !homeOK && strings.HasPrefix(p, filepath.Clean(u.Home)+"/") {
+				continue
+			}
+			usersOfPath[p]++
+			targets = append(targets, TargetFile{Path: p, User: u.Name, UID: u.UID, Optional: true})
+		}
+	}
+	for i, t := range targets {
+		if usersOfPath[t.Path] > 1 {
+			targets[i].User, targets[i].UID = "", 0
+		}
+	}
+	return targets
+}
+
+// A MissingHome is a user whose home directory doesn't exist, or isn't a directory.
+type MissingHome struct {
+	User string `json:"user"`
+	UID  int    `json:"uid"`
+	Home string `json:"home"`
+}
+
+// checkHomeDir returns true if a user's home directory exists and can be read.
+// If it's missing, that's recorded as a MissingHome, and if it can't be read, as a scan error,
+//  except for ignored users, since system accounts often have no home at all.
+func (ctx *ScanContext) checkHomeDir(u PasswdEntry) bool {
+	info, err := os.Stat(u.Home)
+	if (err == nil && !info.IsDir()) || os.IsNotExist(err) {
+		if !ctx.ShouldIgnoreUser(u.Name, u.UID) {
+			log.WithFields(log.Fields{"user": u.Name, "home": u.Home}).Warn("Home directory missing")
+			ctx.MissingHomes = append(ctx.MissingHomes, MissingHome{User: u.Name, UID: u.UID, Home: u.Home})
+		}
+		return false
+	}
+	if err == nil {
+		var f *os.File
+		f, err = os.Open(u.Home)
+		if err == nil {
+			_, err = f.Readdirnames(1)
+			f.Close()
+			if err == io.EOF {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		if !ctx.ShouldIgnoreUser(u.Name, u.UID) {
+			se := newFileScanError(u.Home, StageHome, err)
+			se.User = u.Name
+			ctx.recordScanErrors(*se)
+		}
+		return false
+	}
+	return true
+}
+
+// dedupeTargets drops every target with the same path as an earlier one.
+func dedupeTargets(targets []TargetFile) []TargetFile {
+	seen := make(map[string]bool)
+	deduped := make([]TargetFile, 0, len(targets))
+	for _, t := range targets {
+		if seen[t.Path] {
+			continue
+		}
+		seen[t.Path] = true
+		deduped = append(deduped, t)
+	}
+	return deduped
+}
@@ -0,0 +1,45 @@
+#!/bin/bash
+# Makes the KRLs and keys krl_test.go reads: one KRL for each kind of section ssh-keygen -k writes,
+#  and a key or certificate each one revokes. Run from this directory; the files are committed, so this
+#  only needs running again to change them.
+
+set -o errexit -o nounset -o pipefail
+
+function kg() {
+  ssh-keygen -q -t ed25519 -N "" "$@"
+}
+
+command rm -f ./*.pub ./*.krl
+
+kg -C "CA" -f tmp-ca
+kg -C "revoked explicitly" -f revoked-key
+kg -C "revoked by SHA1 hash" -f sha1-key
+kg -C "revoked by SHA256 hash" -f sha256-key
+kg -C "not revoked" -f other-key
+
+# Certificates, each for a key of its own, with the serial or key ID the KRLs below revoke.
+function cert() {
+  kg -C "$1" -f "$1"
+  ssh-keygen -q -s tmp-ca -I "$2" -z "$3" -n person "$1.pub"
+  command rm "$1" "$1.pub"
+}
+cert serial-5 "serial 5" 5
+cert serial-1050 "serial 1050" 1050
+cert serial-13 "serial 13" 13
+cert key-id "revoked-id" 0
+ssh-keygen -q -s tmp-ca -I "not revoked" -z 7 -n person other-key.pub
+
+# ssh-keygen picks how to write serials: a single one as a list, a run as a range, and scattered ones as a bitmap.
+function krl() {
+  printf "%s\n" "$2" >tmp-spec
+  ssh-keygen -q -k -s tmp-ca.pub -f "$1.krl" tmp-spec
+}
+krl serial-list "serial: 5"
+krl serial-range "serial: 1000-1099"
+krl serial-bitmap "$(printf "serial: %s\n" 1 3 8 13 21 34)"
+krl key-id "id: revoked-id"
+krl explicit-key "key: $(cat revoked-key.pub)"
+krl sha1 "sha1: $(cat sha1-key.pub)"
+krl sha256 "hash: $(ssh-keygen -l -f sha256-key.pub | cut -d ' ' -f 2)"
+
+command rm tmp-* revoked-key sha1-key sha256-key other-key
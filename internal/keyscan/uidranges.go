@@ -0,0 +1,139 @@
+package keyscan
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UIDRangeAction is what to do with the keys of users whose UID falls in a UIDRange.
+type UIDRangeAction string
+
+const (
+	UIDRangeIgnore  UIDRangeAction = "ignore"  // Treat them as ignored owners
+	UIDRangeScan    UIDRangeAction = "scan"    // Check them as usual
+	UIDRangeProfile UIDRangeAction = "profile" // Check them with a named policy profile instead of the usual key policy
+)
+
+// A UIDRange picks out users by UID, from Min to Max inclusive, and says what to do with them.
+type UIDRange struct {
+	Min     int            `json:"min"`
+	Max     int            `json:"max"` // -1 if the range has no upper end
+	Action  UIDRangeAction `json:"action"`
+	Profile string         `json:"profile,omitempty"` // The policy profile, for UIDRangeProfile
+}
+
+// ParseUIDRange makes a UIDRange from the config's form of one, e.g. "60000-65000", "1000000-" (with no upper end)
+//  or "0" (just that UID), with an action of ignore, scan or profile.
+func ParseUIDRange(uids string, action string, profile string) (UIDRange, error) {
+	r := UIDRange{Action: UIDRangeAction(strings.ToLower(action)), Profile: profile}
+	switch r.Action {
+	case UIDRangeIgnore, UIDRangeScan:
+		if profile != "" {
+			return r, fmt.Errorf("UID range %q: a profile can only be given with the profile action", uids)
+		}
+	case UIDRangeProfile:
+		if profile == "" {
+			return r, fmt.Errorf("UID range %q: the profile action needs a profile", uids)
+		}
+	default:
+		return r, fmt.Errorf("UID range %q: invalid action %q: must be ignore, scan or profile", uids, action)
+	}
+
+	var err error
+	r.Min, r.Max, err = parseUIDSpan(uids)
+	return r, err
+}
+
+// parseUIDSpan reads the lower and upper ends of a range of UIDs, e.g. "60000-65000", "1000000-" or "0",
+//  with -1 for the upper end if there isn't one.
+func parseUIDSpan(uids string) (int, int, error) {
+	minText, maxText := uids, uids
+	if i := strings.IndexByte(uids, '-'); i != -1 {
+		minText, maxText = strings.TrimSpace(uids[:i]), strings.TrimSpace(uids[i+1:])
+	}
+	min, err := strconv.Atoi(minText)
+	if err != nil || min < 0 {
+		return 0, 0, fmt.Errorf("UID range %q: invalid lower end %q", uids, minText)
+	}
+	if maxText == "" {
+		return min, -1, nil
+	}
+	max, err := strconv.Atoi(maxText)
+	if err != nil {
+		return 0, 0, fmt.Errorf("UID range %q: invalid upper end %q", uids, maxText)
+	}
+	if max < min {
+		return 0, 0, fmt.Errorf("UID range %q: upper end is below lower end", uids)
+	}
+	return min, max, nil
+}
+
+// Contains returns true if uid is in the range.
+func (r UIDRange) Contains(uid int) bool {
+	return uid >= r.Min && (r.Max == -1 || uid <= r.Max)
+}
+
+func (r UIDRange) String() string {
+	if r.Max == -1 {
+		return fmt.Sprintf("%d-", r.Min)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// effectiveUIDRanges returns the UID ranges, or if there aren't any, a range ignoring everyone below LowerUIDBound,
+//  which is all that could be configured before there were ranges.
+func (sp *ScanParams) effectiveUIDRanges() []UIDRange {
+	if len(sp.UIDRanges) != 0 || sp.LowerUIDBound <= 0 {
+		return sp.UIDRanges
+	}
+	return []UIDRange{{Min: 0, Max: sp.LowerUIDBound - 1, Action: UIDRangeIgnore}}
+}
+
+// UIDRangeFor returns the first range a UID is in, and false if it's in none, in which case it's scanned as usual.
+func (sp *ScanParams) UIDRangeFor(uid int) (UIDRange, bool) {
+	for _, r := range sp.effectiveUIDRanges() {
+		if r.Contains(uid) {
+			return r, true
+		}
+	}
+	return UIDRange{}, false
+}
+
+// UIDRangeForUser is UIDRangeFor for a username, looking up their UID in dir.
+// If they can't be looked up, the error is returned rather than guessing which range they'd be in.
+func (sp *ScanParams) UIDRangeForUser(dir UserDirectory, username string) (UIDRange, bool, error) {
+	uid, err := getUIDForUser(dir, username)
+	if err != nil {
+		return UIDRange{}, false, err
+	}
+	r, ok := sp.UIDRangeFor(uid)
+	return r, ok, nil
+}
+
+// uidIgnored returns true if a UID is in a range with the ignore action.
+func (sp *ScanParams) uidIgnored(uid int) bool {
+	r, ok := sp.UIDRangeFor(uid)
+	return ok && r.Action == UIDRangeIgnore
+}
+
+// CheckUIDRanges returns an error for the first range using a policy profile that doesn't exist.
+func (sp *ScanParams) CheckUIDRanges() error {
+	for _, r := range sp.UIDRanges {
+		if _, ok := sp.PolicyProfiles[r.Profile]; r.Action == UIDRangeProfile && !ok {
+			return fmt.Errorf("UID range %v uses policy profile %q, which isn't defined in policy_profiles", r, r.Profile)
+		}
+	}
+	return nil
+}
+
+// KeyPolicyFor returns the key policy for a key: its owner's UID range's policy profile if it has one,
+//  or the usual KeyPolicy if not. The profile's name is returned too, or "" for the usual policy.
+func (sp *ScanParams) KeyPolicyFor(k OwnedPubKey) (KeyPolicy, string) {
+	if r, ok := sp.UIDRangeFor(k.OwnerID); ok && r.Action == UIDRangeProfile {
+		if profile, ok := sp.PolicyProfiles[r.Profile]; ok {
+			return profile, r.Profile
+		}
+	}
+	return sp.KeyPolicy, ""
+}
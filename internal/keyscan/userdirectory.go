@@ -0,0 +1,560 @@
+package keyscan
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// A UserDirectory looks up accounts and their groups, e.g. to find the name of a key file's owner.
+// Users that don't exist are reported with os/user's UnknownUserError and UnknownUserIdError,
+//  whichever directory they were looked up in, so that callers can tell them apart from lookups that failed.
+type UserDirectory interface {
+	UserByName(name string) (PasswdEntry, error)
+	UserByUID(uid int) (PasswdEntry, error)
+	GroupNames(u PasswdEntry) ([]string, error) // Every group the user is in, including their primary group
+	String() string                             // Where the users come from, for logs and errors
+}
+
+// DirectoryParams says which UserDirectory to look users up in, and how to reach it.
+type DirectoryParams struct {
+	Directory            string `json:"user_directory"`          // os (the default), files or ldap
+	PasswdFile           string `json:"passwd_file"`             // For files and ldap: the passwd file. Defaults to /etc/passwd
+	GroupFile            string `json:"group_file"`              // For files and ldap: the group file. Defaults to /etc/group
+	LDAPURL              string `json:"ldap_url"`                // ldap://host or ldaps://host
+	LDAPBindDN           string `json:"ldap_bind_dn"`            // Leave empty to bind anonymously
+	LDAPBindPasswordFile string `json:"ldap_bind_password_file"` // A file holding the bind password, so it isn't in the config or report
+	LDAPUserBaseDN       string `json:"ldap_user_base_dn"`       // Where to search for posixAccount entries
+	LDAPGroupBaseDN      string `json:"ldap_group_base_dn"`      // Where to search for posixGroup entries. Defaults to the user base DN
+	LDAPStartTLS         bool   `json:"ldap_start_tls"`          // For ldap:// URLs, encrypt the connection with StartTLS before binding
+	LDAPCACertFile       string `json:"ldap_ca_cert_file"`       // PEM certificates of the CAs to trust for ldaps:// and StartTLS, instead of the system's
+	LDAPTimeout          int    `json:"ldap_timeout_seconds"`    // For connecting and for each search. 0 waits forever
+}
+
+// NewUserDirectory makes the UserDirectory described by dp.
+// The ldap kind looks in the local passwd and group files first, since system accounts like root usually aren't in LDAP.
+// Nothing is connected to or read until the first lookup, except the LDAP bind password.
+func NewUserDirectory(dp DirectoryParams) (UserDirectory, error) {
+	files := &FileUserDirectory{PasswdPath: dp.PasswdFile, GroupPath: dp.GroupFile}
+	if files.PasswdPath == "" {
+		files.PasswdPath = PasswdFile
+	}
+	if files.GroupPath == "" {
+		files.GroupPath = GroupFile
+	}
+
+	switch dp.Directory {
+	case "", "os":
+		return OSUserDirectory{}, nil
+	case "files":
+		return files, nil
+	case "ldap":
+		if dp.LDAPURL == "" || dp.LDAPUserBaseDN == "" {
+			return nil, errors.New("user directory \"ldap\" needs ldap_url and ldap_user_base_dn")
+		}
+		d := &LDAPUserDirectory{URL: dp.LDAPURL, BindDN: dp.LDAPBindDN, UserBaseDN: dp.LDAPUserBaseDN,
+			GroupBaseDN: dp.LDAPGroupBaseDN, StartTLS: dp.LDAPStartTLS, Timeout: time.Duration(dp.LDAPTimeout) * time.Second}
+		if d.GroupBaseDN == "" {
+			d.GroupBaseDN = d.UserBaseDN
+		}
+		u, err := url.Parse(dp.LDAPURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ldap_url: %v", err)
+		}
+		switch {
+		case u.Scheme != "ldap" && u.Scheme != "ldaps":
+			return nil, fmt.Errorf("invalid ldap_url %q: must be ldap:// or ldaps://", dp.LDAPURL)
+		case u.Scheme == "ldaps" && d.StartTLS:
+			return nil, errors.New("ldap_start_tls is for ldap:// URLs: ldaps:// is encrypted already")
+		}
+		d.TLSConfig = &tls.Config{ServerName: u.Hostname()}
+		if dp.LDAPCACertFile != "" {
+			pem, err := ioutil.ReadFile(dp.LDAPCACertFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading LDAP CA certificates: %v", err)
+			}
+			d.TLSConfig.RootCAs = x509.NewCertPool()
+			if !d.TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", dp.LDAPCACertFile)
+			}
+		}
+		if dp.LDAPBindPasswordFile != "" {
+			password, err := ioutil.ReadFile(dp.LDAPBindPasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading LDAP bind password: %v", err)
+			}
+			d.BindPassword = strings.TrimRight(string(password), "\r\n")
+		}
+		if d.BindPassword != "" && u.Scheme == "ldap" && !d.StartTLS {
+			return nil, errors.New("binding to an ldap:// URL would send the password unencrypted: use ldaps://, or set ldap_start_tls")
+		}
+		return ChainUserDirectory{files, d}, nil
+	}
+	return nil, fmt.Errorf("invalid user directory %q: must be os, files or ldap", dp.Directory)
+}
+
+// isUnknownUser returns true if err says the user doesn't exist, rather than that the lookup failed.
+func isUnknownUser(err error) bool {
+	var byName user.UnknownUserError
+	var byID user.UnknownUserIdError
+	return errors.As(err, &byName) || errors.As(err, &byID)
+}
+
+// OSUserDirectory looks users up with os/user, i.e. through NSS, or by reading /etc/passwd
+//  and /etc/group if keyscan was built without cgo.
+type OSUserDirectory struct{}
+
+func (OSUserDirectory) UserByName(name string) (PasswdEntry, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return PasswdEntry{}, err
+	}
+	return passwdEntryFromOSUser(u)
+}
+
+func (OSUserDirectory) UserByUID(uid int) (PasswdEntry, error) {
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return PasswdEntry{}, err
+	}
+	return passwdEntryFromOSUser(u)
+}
+
+func (OSUserDirectory) GroupNames(pe PasswdEntry) ([]string, error) {
+	u, err := user.Lookup(pe.Name)
+	if err != nil {
+		return nil, err
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(gids))
+	for _, gid := range gids {
+		g, err := user.LookupGroupId(gid)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, g.Name)
+	}
+	return names, nil
+}
+
+func (OSUserDirectory) String() string {
+	return "os"
+}
+
+// passwdEntryFromOSUser converts a user.User. It doesn't have a shell, so that's left empty.
+func passwdEntryFromOSUser(u *user.User) (PasswdEntry, error) {
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return PasswdEntry{}, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return PasswdEntry{}, err
+	}
+	return PasswdEntry{Name: u.Username, UID: uid, GID: gid, Home: u.HomeDir}, nil
+}
+
+// FileUserDirectory looks users up in a passwd file and groups in a group file, e.g. copies taken from another machine.
+// Both files are read on the first lookup, and not again.
+type FileUserDirectory struct {
+	PasswdPath string
+	GroupPath  string
+
+	once   sync.Once
+	users  []PasswdEntry
+	groups []GroupEntry
+	err    error
+}
+
+func (d *FileUserDirectory) load() error {
+	d.once.Do(func() {
+		d.users, d.err = (PasswdFileUserSource{Path: d.PasswdPath}).Users()
+		if d.err != nil {
+			return
+		}
+		f, err := os.Open(d.GroupPath)
+		if err != nil {
+			d.err = err
+			return
+		}
+		defer f.Close()
+		d.groups, d.err = ParseGroup(f)
+		if d.err != nil {
+			d.err = fmt.Errorf("%s: %v", d.GroupPath, d.err)
+		}
+	})
+	return d.err
+}
+
+func (d *FileUserDirectory) UserByName(name string) (PasswdEntry, error) {
+	if err := d.load(); err != nil {
+		return PasswdEntry{}, err
+	}
+	for _, u := range d.users {
+		if u.Name == name {
+			return u, nil
+		}
+	}
+	return PasswdEntry{}, user.UnknownUserError(name)
+}
+
+func (d *FileUserDirectory) UserByUID(uid int) (PasswdEntry, error) {
+	if err := d.load(); err != nil {
+		return PasswdEntry{}, err
+	}
+	for _, u := range d.users {
+		if u.UID == uid {
+			return u, nil
+		}
+	}
+	return PasswdEntry{}, user.UnknownUserIdError(uid)
+}
+
+// GroupNames returns the groups listing the user as a member, plus their primary group if it's in the file.
+func (d *FileUserDirectory) GroupNames(u PasswdEntry) ([]string, error) {
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, g := range d.groups {
+		if g.GID == u.GID || stringInStringSlice(u.Name, g.Members) {
+			names = append(names, g.Name)
+		}
+	}
+	return names, nil
+}
+
+func (d *FileUserDirectory) String() string {
+	return d.PasswdPath + " and " + d.GroupPath
+}
+
+// LDAPUserDirectory looks users up as posixAccount entries and groups as posixGroup entries in an LDAP directory.
+// One connection is made on the first lookup and shared by every lookup after, one at a time.
+// If the server can't be reached at all, no more attempts are made, so that a scan doesn't wait out
+//  the timeout once for every user.
+// Searches are paged, for servers that limit how many entries one search returns, but referrals to
+//  other servers aren't followed.
+type LDAPUserDirectory struct {
+	URL          string
+	BindDN       string
+	BindPassword string
+	UserBaseDN   string
+	GroupBaseDN  string
+	StartTLS     bool        // Encrypt an ldap:// connection before binding
+	TLSConfig    *tls.Config // For ldaps:// and StartTLS. It needs a ServerName for StartTLS
+	Timeout      time.Duration
+
+	mu      sync.Mutex
+	conn    *ldap.Conn
+	dialErr error
+}
+
+var ldapUserAttributes = []string{"uid", "uidNumber", "gidNumber", "homeDirectory", "loginShell"}
+
+// ldapPageSize is how many entries are asked for at a time, below the usual server limits (e.g. 500 for OpenLDAP).
+const ldapPageSize = 250
+
+func (d *LDAPUserDirectory) UserByName(name string) (PasswdEntry, error) {
+	entries, err := d.search(d.UserBaseDN, "(&(objectClass=posixAccount)(uid="+ldap.EscapeFilter(name)+"))", ldapUserAttributes)
+	if err != nil {
+		return PasswdEntry{}, err
+	}
+	if len(entries) == 0 {
+		return PasswdEntry{}, user.UnknownUserError(name)
+	}
+	return passwdEntryFromLDAP(entries[0])
+}
+
+func (d *LDAPUserDirectory) UserByUID(uid int) (PasswdEntry, error) {
+	entries, err := d.search(d.UserBaseDN, "(&(objectClass=posixAccount)(uidNumber="+strconv.Itoa(uid)+"))", ldapUserAttributes)
+	if err != nil {
+		return PasswdEntry{}, err
+	}
+	if len(entries) == 0 {
+		return PasswdEntry{}, user.UnknownUserIdError(uid)
+	}
+	return passwdEntryFromLDAP(entries[0])
+}
+
+// GroupNames returns the groups listing the user in memberUid, plus their primary group.
+func (d *LDAPUserDirectory) GroupNames(u PasswdEntry) ([]string, error) {
+	filter := "(&(objectClass=posixGroup)(|(memberUid=" + ldap.EscapeFilter(u.Name) + ")(gidNumber=" + strconv.Itoa(u.GID) + ")))"
+	entries, err := d.search(d.GroupBaseDN, filter, []string{"cn"})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if cn := e.GetEqualFoldAttributeValue("cn"); cn != "" {
+			names = append(names, cn)
+		}
+	}
+	return names, nil
+}
+
+func (d *LDAPUserDirectory) String() string {
+	return d.URL
+}
+
+// search runs a subtree search, connecting first if need be.
+// If the connection has broken (rather than the server returning an error), it's made again and the search retried, once.
+func (d *LDAPUserDirectory) search(base string, filter string, attributes []string) ([]*ldap.Entry, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	req := ldap.NewSearchRequest(base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(d.Timeout/time.Second), false,
+		filter, attributes, nil)
+	for attempt := 0; ; attempt++ {
+		if err := d.connect(); err != nil {
+			return nil, err
+		}
+		result, err := d.conn.SearchWithPaging(req, ldapPageSize)
+		if err == nil {
+			if len(result.Referrals) != 0 {
+				log.WithFields(log.Fields{"url": d.URL, "filter": filter, "referrals": result.Referrals}).Warn("LDAP referrals not followed")
+			}
+			return result.Entries, nil
+		}
+		if !ldap.IsErrorWithCode(err, ldap.ErrorNetwork) || attempt > 0 {
+			return nil, fmt.Errorf("searching %s for %s: %v", d.URL, filter, err)
+		}
+		log.WithFields(log.Fields{"url": d.URL, "error": err}).Warn("LDAP connection failed, reconnecting")
+		d.conn.Close()
+		d.conn = nil
+		req.Controls = nil // The paging control from the broken connection's search
+	}
+}
+
+// connect makes the connection, encrypts it if need be, and binds, if that hasn't been done already. d.mu must be held.
+func (d *LDAPUserDirectory) connect() error {
+	if d.conn != nil {
+		return nil
+	}
+	if d.dialErr != nil {
+		return d.dialErr
+	}
+	conn, err := ldap.DialURL(d.URL, ldap.DialWithDialer(&net.Dialer{Timeout: d.Timeout}), ldap.DialWithTLSConfig(d.TLSConfig))
+	if err == nil {
+		conn.SetTimeout(d.Timeout)
+		if d.StartTLS {
+			err = conn.StartTLS(d.TLSConfig)
+		}
+		if err == nil {
+			if d.BindDN == "" && d.BindPassword == "" {
+				err = conn.UnauthenticatedBind("")
+			} else {
+				err = conn.Bind(d.BindDN, d.BindPassword)
+			}
+		}
+		if err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		d.dialErr = fmt.Errorf("connecting to %s: %v", d.URL, err)
+		return d.dialErr
+	}
+	d.conn = conn
+	return nil
+}
+
+// Close closes the connection, if there is one. The next lookup will connect again.
+func (d *LDAPUserDirectory) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn == nil {
+		return nil
+	}
+	d.conn.Close()
+	d.conn = nil
+	return nil
+}
+
+func passwdEntryFromLDAP(e *ldap.Entry) (PasswdEntry, error) {
+	uid, err := strconv.Atoi(e.GetEqualFoldAttributeValue("uidNumber"))
+	if err != nil {
+		return PasswdEntry{}, fmt.Errorf("%s: invalid uidNumber %q", e.DN, e.GetEqualFoldAttributeValue("uidNumber"))
+	}
+	gid, err := strconv.Atoi(e.GetEqualFoldAttributeValue("gidNumber"))
+	if err != nil {
+		return PasswdEntry{}, fmt.Errorf("%s: invalid gidNumber %q", e.DN, e.GetEqualFoldAttributeValue("gidNumber"))
+	}
+	return PasswdEntry{Name: e.GetEqualFoldAttributeValue("uid"), UID: uid, GID: gid,
+		Home: e.GetEqualFoldAttributeValue("homeDirectory"), Shell: e.GetEqualFoldAttributeValue("loginShell")}, nil
+}
+
+// ChainUserDirectory looks users up in each of its directories in turn, until one has them.
+// A user's groups are the groups from every directory put together, since e.g. a local group can list
+//  users from LDAP.
+type ChainUserDirectory []UserDirectory
+
+func (c ChainUserDirectory) UserByName(name string) (PasswdEntry, error) {
+	var err error = user.UnknownUserError(name)
+	for _, d := range c {
+		var u PasswdEntry
+		if u, err = d.UserByName(name); err == nil || !isUnknownUser(err) {
+			return u, err
+		}
+	}
+	return PasswdEntry{}, err
+}
+
+func (c ChainUserDirectory) UserByUID(uid int) (PasswdEntry, error) {
+	var err error = user.UnknownUserIdError(uid)
+	for _, d := range c {
+		var u PasswdEntry
+		if u, err = d.UserByUID(uid); err == nil || !isUnknownUser(err) {
+			return u, err
+		}
+	}
+	return PasswdEntry{}, err
+}
+
+// GroupNames returns every group found, and the first error, if any directory couldn't be searched.
+func (c ChainUserDirectory) GroupNames(u PasswdEntry) ([]string, error) {
+	names := make([]string, 0)
+	var firstErr error
+	for _, d := range c {
+		dirNames, err := d.GroupNames(u)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		for _, n := range dirNames {
+			if !stringInStringSlice(n, names) {
+				names = append(names, n)
+			}
+		}
+	}
+	return names, firstErr
+}
+
+func (c ChainUserDirectory) String() string {
+	names := make([]string, len(c))
+	for i, d := range c {
+		names[i] = d.String()
+	}
+	return strings.Join(names, ", then ")
+}
+
+// CachingUserDirectory remembers every answer from another UserDirectory, including errors, so that each
+//  user is only looked up once however many files they own.
+// It's safe to use from more than one goroutine. Lookups of different users happen at the same time, and
+//  a lookup of a user that's already under way is waited for rather than done again.
+type CachingUserDirectory struct {
+	Directory UserDirectory
+
+	mu     sync.Mutex // Guards the maps, but isn't held during lookups
+	byName map[string]*userLookup
+	byUID  map[int]*userLookup
+	groups map[string]*groupsLookup
+}
+
+type userLookup struct {
+	done chan struct{} // Closed once user and err are set
+	user PasswdEntry
+	err  error
+}
+
+func (l *userLookup) wait() (PasswdEntry, error) {
+	<-l.done
+	return l.user, l.err
+}
+
+type groupsLookup struct {
+	done  chan struct{} // Closed once names and err are set
+	names []string
+	err   error
+}
+
+// NewCachingUserDirectory wraps d in a cache.
+func NewCachingUserDirectory(d UserDirectory) *CachingUserDirectory {
+	return &CachingUserDirectory{
+		Directory: d,
+		byName:    make(map[string]*userLookup),
+		byUID:     make(map[int]*userLookup),
+		groups:    make(map[string]*groupsLookup),
+	}
+}
+
+func (c *CachingUserDirectory) UserByName(name string) (PasswdEntry, error) {
+	c.mu.Lock()
+	l, ok := c.byName[name]
+	if ok {
+		c.mu.Unlock()
+		return l.wait()
+	}
+	l = &userLookup{done: make(chan struct{})}
+	c.byName[name] = l
+	c.mu.Unlock()
+
+	l.user, l.err = c.Directory.UserByName(name)
+	close(l.done)
+	if l.err == nil {
+		c.mu.Lock()
+		if _, known := c.byUID[l.user.UID]; !known {
+			c.byUID[l.user.UID] = l
+		}
+		c.mu.Unlock()
+	}
+	return l.user, l.err
+}
+
+func (c *CachingUserDirectory) UserByUID(uid int) (PasswdEntry, error) {
+	c.mu.Lock()
+	l, ok := c.byUID[uid]
+	if ok {
+		c.mu.Unlock()
+		return l.wait()
+	}
+	l = &userLookup{done: make(chan struct{})}
+	c.byUID[uid] = l
+	c.mu.Unlock()
+
+	l.user, l.err = c.Directory.UserByUID(uid)
+	close(l.done)
+	if l.err == nil {
+		c.mu.Lock()
+		if _, known := c.byName[l.user.Name]; !known {
+			c.byName[l.user.Name] = l
+		}
+		c.mu.Unlock()
+	}
+	return l.user, l.err
+}
+
+// GroupNames caches by user name, so it assumes one user's entry doesn't change during a scan.
+func (c *CachingUserDirectory) GroupNames(u PasswdEntry) ([]string, error) {
+	c.mu.Lock()
+	l, ok := c.groups[u.Name]
+	if ok {
+		c.mu.Unlock()
+		<-l.done
+		return l.names, l.err
+	}
+	l = &groupsLookup{done: make(chan struct{})}
+	c.groups[u.Name] = l
+	c.mu.Unlock()
+
+	l.names, l.err = c.Directory.GroupNames(u)
+	close(l.done)
+	return l.names, l.err
+}
+
+func (c *CachingUserDirectory) String() string {
+	return c.Directory.String()
+}
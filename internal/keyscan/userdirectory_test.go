@@ -0,0 +1,385 @@
+package keyscan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/UCL-RITS/keyscan/internal/ldaptest"
+)
+
+const (
+	testPeopleDN = "ou=people,dc=example,dc=org"
+	testGroupsDN = "ou=groups,dc=example,dc=org"
+)
+
+func newTestLDAPServer(t *testing.T) *ldaptest.Server {
+	s, err := ldaptest.NewServer(
+		ldaptest.PosixAccount(testPeopleDN, "alice", "1000", "1000", "/home/alice", "/bin/bash"),
+		ldaptest.PosixAccount(testPeopleDN, "bob", "1001", "100", "/home/bob", "/bin/sh"),
+		ldaptest.PosixAccount(testPeopleDN, "broken", "not-a-number", "100", "/home/broken", "/bin/sh"),
+		ldaptest.PosixGroup(testGroupsDN, "alice", "1000"),
+		ldaptest.PosixGroup(testGroupsDN, "users", "100"),
+		ldaptest.PosixGroup(testGroupsDN, "admins", "200", "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newTestLDAPDirectory(s *ldaptest.Server) *LDAPUserDirectory {
+	return &LDAPUserDirectory{URL: s.URL, BindDN: s.BindDN, BindPassword: s.BindPassword,
+		UserBaseDN: testPeopleDN, GroupBaseDN: testGroupsDN, Timeout: 5 * time.Second}
+}
+
+// writeTestFiles writes a passwd and a group file into a temporary directory, and returns a directory for them.
+func writeTestFiles(t *testing.T, passwd, group string) *FileUserDirectory {
+	dir, err := ioutil.TempDir("", "keyscan-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	d := &FileUserDirectory{PasswdPath: filepath.Join(dir, "passwd"), GroupPath: filepath.Join(dir, "group")}
+	if err := ioutil.WriteFile(d.PasswdPath, []byte(passwd), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(d.GroupPath, []byte(group), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func sortedGroupNames(t *testing.T, d UserDirectory, u PasswdEntry) []string {
+	names, err := d.GroupNames(u)
+	if err != nil {
+		t.Fatalf("GroupNames(%s): %v", u.Name, err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLDAPUserDirectory(t *testing.T) {
+	s := newTestLDAPServer(t)
+	defer s.Close()
+	d := newTestLDAPDirectory(s)
+	defer d.Close()
+
+	alice := PasswdEntry{Name: "alice", UID: 1000, GID: 1000, Home: "/home/alice", Shell: "/bin/bash"}
+	if u, err := d.UserByName("alice"); err != nil || u != alice {
+		t.Errorf("UserByName(alice) = %+v, %v", u, err)
+	}
+	if u, err := d.UserByUID(1000); err != nil || u != alice {
+		t.Errorf("UserByUID(1000) = %+v, %v", u, err)
+	}
+	if got, want := sortedGroupNames(t, d, alice), []string{"admins", "alice"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("alice's groups = %v, want %v", got, want)
+	}
+
+	if _, err := d.UserByName("nobody"); !isUnknownUser(err) {
+		t.Errorf("UserByName(nobody) = %v, want an unknown user error", err)
+	}
+	if _, err := d.UserByUID(4242); !isUnknownUser(err) {
+		t.Errorf("UserByUID(4242) = %v, want an unknown user error", err)
+	}
+	if _, err := d.UserByName("broken"); err == nil || isUnknownUser(err) {
+		t.Errorf("UserByName(broken) = %v, want an invalid uidNumber error", err)
+	}
+	// Values go into the filter escaped, rather than matching everyone.
+	if _, err := d.UserByName("*"); !isUnknownUser(err) {
+		t.Errorf("UserByName(*) = %v, want an unknown user error", err)
+	}
+}
+
+func TestLDAPUserDirectoryBind(t *testing.T) {
+	s := newTestLDAPServer(t)
+	defer s.Close()
+	s.BindDN, s.BindPassword = "cn=keyscan,dc=example,dc=org", "secret"
+
+	d := newTestLDAPDirectory(s)
+	if _, err := d.UserByName("alice"); err != nil {
+		t.Errorf("UserByName with the right password: %v", err)
+	}
+	d.Close()
+
+	d = newTestLDAPDirectory(s)
+	d.BindPassword = "wrong"
+	if _, err := d.UserByName("alice"); err == nil || isUnknownUser(err) {
+		t.Errorf("UserByName with the wrong password = %v, want a bind error", err)
+	}
+	if s.Searches() != 1 {
+		t.Errorf("server answered %d searches, want 1", s.Searches())
+	}
+}
+
+func TestLDAPUserDirectoryReconnects(t *testing.T) {
+	s := newTestLDAPServer(t)
+	defer s.Close()
+	d := newTestLDAPDirectory(s)
+	defer d.Close()
+	if _, err := d.UserByName("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Break the connection under the directory; the next lookup should connect again and carry on.
+	d.mu.Lock()
+	d.conn.Close()
+	d.mu.Unlock()
+	if u, err := d.UserByName("bob"); err != nil || u.UID != 1001 {
+		t.Errorf("UserByName(bob) after the connection broke = %+v, %v", u, err)
+	}
+}
+
+func TestLDAPUserDirectoryStartTLS(t *testing.T) {
+	s := newTestLDAPServer(t)
+	defer s.Close()
+	s.BindDN, s.BindPassword = "cn=keyscan,dc=example,dc=org", "secret"
+	cert, err := s.StartTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := writeTestFiles(t, "", "")
+	dir := filepath.Dir(files.PasswdPath)
+	for name, contents := range map[string]string{"ca.pem": string(cert), "password": s.BindPassword + "\n"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dp := DirectoryParams{Directory: "ldap", PasswdFile: files.PasswdPath, GroupFile: files.GroupPath,
+		LDAPURL: s.URL, LDAPBindDN: s.BindDN, LDAPBindPasswordFile: filepath.Join(dir, "password"),
+		LDAPUserBaseDN: testPeopleDN, LDAPGroupBaseDN: testGroupsDN, LDAPTimeout: 5}
+
+	// Without StartTLS the password would go over the network in the clear.
+	if _, err := NewUserDirectory(dp); err == nil {
+		t.Error("NewUserDirectory binding with a password over plain ldap:// succeeded")
+	}
+
+	dp.LDAPStartTLS = true
+	d, err := NewUserDirectory(dp)
+	if err == nil {
+		_, err = d.UserByName("bob")
+	}
+	if err == nil {
+		t.Error("StartTLS trusting only the system's CAs succeeded")
+	}
+
+	dp.LDAPCACertFile = filepath.Join(dir, "ca.pem")
+	d, err = NewUserDirectory(dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := d.UserByName("bob"); err != nil || u.UID != 1001 {
+		t.Errorf("UserByName(bob) over StartTLS = %+v, %v", u, err)
+	}
+	if got, want := sortedGroupNames(t, d, PasswdEntry{Name: "alice", GID: 1000}), []string{"admins", "alice"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("alice's groups over StartTLS = %v, want %v", got, want)
+	}
+
+	dp.LDAPURL = "ldaps" + strings.TrimPrefix(s.URL, "ldap")
+	if _, err := NewUserDirectory(dp); err == nil {
+		t.Error("NewUserDirectory with both ldaps:// and ldap_start_tls succeeded")
+	}
+}
+
+func TestLDAPUserDirectoryUnreachable(t *testing.T) {
+	s := newTestLDAPServer(t)
+	d := newTestLDAPDirectory(s)
+	s.Close()
+
+	_, err := d.UserByName("alice")
+	if err == nil || isUnknownUser(err) {
+		t.Fatalf("UserByName with the server down = %v, want a connection error", err)
+	}
+	if _, again := d.UserByUID(1000); again != err {
+		t.Errorf("second lookup = %v, want the first connection error again without redialling", again)
+	}
+}
+
+func TestChainUserDirectory(t *testing.T) {
+	s := newTestLDAPServer(t)
+	defer s.Close()
+	ldapDir := newTestLDAPDirectory(s)
+	defer ldapDir.Close()
+	files := writeTestFiles(t,
+		"root:x:0:0:root:/root:/bin/bash\nalice:x:1000:1000:Local Alice:/local/alice:/bin/zsh\n",
+		"root:x:0:\nwheel:x:10:alice,root\n")
+	c := ChainUserDirectory{files, ldapDir}
+
+	// The first directory that has a user wins.
+	if u, err := c.UserByName("alice"); err != nil || u.Home != "/local/alice" {
+		t.Errorf("UserByName(alice) = %+v, %v, want the local entry", u, err)
+	}
+	bob, err := c.UserByName("bob")
+	if err != nil || bob.UID != 1001 {
+		t.Errorf("UserByName(bob) = %+v, %v, want the LDAP entry", bob, err)
+	}
+	if u, err := c.UserByUID(0); err != nil || u.Name != "root" {
+		t.Errorf("UserByUID(0) = %+v, %v", u, err)
+	}
+	if _, err := c.UserByUID(4242); !isUnknownUser(err) {
+		t.Errorf("UserByUID(4242) = %v, want an unknown user error", err)
+	}
+	if s.Searches() != 2 {
+		t.Errorf("LDAP server answered %d searches, want 2: users in the local files shouldn't be looked for", s.Searches())
+	}
+
+	// Groups come from every directory.
+	alice := PasswdEntry{Name: "alice", UID: 1000, GID: 1000}
+	if got, want := sortedGroupNames(t, c, alice), []string{"admins", "alice", "wheel"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("alice's groups = %v, want %v", got, want)
+	}
+
+	if got, want := c.String(), files.String()+", then "+s.URL; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestChainUserDirectoryStopsOnError(t *testing.T) {
+	s := newTestLDAPServer(t)
+	ldapDir := newTestLDAPDirectory(s)
+	s.Close()
+	files := writeTestFiles(t, "root:x:0:0:root:/root:/bin/bash\nalice:x:1000:1000::/home/alice:/bin/sh\n", "wheel:x:10:alice\n")
+
+	// A failed lookup isn't the same as the user not existing, so it's passed on rather than hidden.
+	if _, err := (ChainUserDirectory{ldapDir, files}).UserByName("alice"); err == nil || isUnknownUser(err) {
+		t.Errorf("UserByName with LDAP down = %v, want the connection error", err)
+	}
+	names, err := (ChainUserDirectory{files, ldapDir}).GroupNames(PasswdEntry{Name: "alice", GID: 1000})
+	if err == nil {
+		t.Error("GroupNames with LDAP down succeeded")
+	}
+	if !reflect.DeepEqual(names, []string{"wheel"}) {
+		t.Errorf("GroupNames with LDAP down = %v, want the local groups", names)
+	}
+}
+
+func TestCachingUserDirectory(t *testing.T) {
+	s := newTestLDAPServer(t)
+	defer s.Close()
+	ldapDir := newTestLDAPDirectory(s)
+	defer ldapDir.Close()
+	c := NewCachingUserDirectory(ldapDir)
+
+	for i := 0; i < 3; i++ {
+		if u, err := c.UserByName("alice"); err != nil || u.UID != 1000 {
+			t.Fatalf("UserByName(alice) = %+v, %v", u, err)
+		}
+		if u, err := c.UserByUID(1000); err != nil || u.Name != "alice" {
+			t.Fatalf("UserByUID(1000) = %+v, %v", u, err)
+		}
+		if _, err := c.UserByName("nobody"); !isUnknownUser(err) {
+			t.Fatalf("UserByName(nobody) = %v, want an unknown user error", err)
+		}
+		if _, err := c.GroupNames(PasswdEntry{Name: "alice", GID: 1000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// alice by name, which also answers by UID; nobody; and alice's groups.
+	if s.Searches() != 3 {
+		t.Errorf("LDAP server answered %d searches, want 3", s.Searches())
+	}
+
+	if u, err := c.UserByUID(1001); err != nil || u.Name != "bob" {
+		t.Errorf("UserByUID(1001) = %+v, %v", u, err)
+	}
+	if _, err := c.UserByName("bob"); err != nil || s.Searches() != 4 {
+		t.Errorf("UserByName(bob) after UserByUID(1001) = %v, with %d searches, want 4", err, s.Searches())
+	}
+}
+
+// blockingUserDirectory knows every user, but each lookup waits for release to be closed, and says it has started on started.
+type blockingUserDirectory struct {
+	started chan string
+	release chan struct{}
+}
+
+func (d blockingUserDirectory) UserByName(name string) (PasswdEntry, error) {
+	d.started <- name
+	<-d.release
+	return PasswdEntry{Name: name, UID: 1000 + len(name)}, nil
+}
+
+func (d blockingUserDirectory) UserByUID(uid int) (PasswdEntry, error) {
+	d.started <- fmt.Sprint(uid)
+	<-d.release
+	return PasswdEntry{Name: fmt.Sprint("user", uid), UID: uid}, nil
+}
+
+func (d blockingUserDirectory) GroupNames(u PasswdEntry) ([]string, error) {
+	d.started <- "groups of " + u.Name
+	<-d.release
+	return []string{u.Name}, nil
+}
+
+func (d blockingUserDirectory) String() string {
+	return "blocking"
+}
+
+func TestCachingUserDirectoryConcurrent(t *testing.T) {
+	d := blockingUserDirectory{started: make(chan string, 100), release: make(chan struct{})}
+	c := NewCachingUserDirectory(d)
+
+	var wg sync.WaitGroup
+	lookUp := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		lookUp(func() {
+			if u, err := c.UserByName("alice"); err != nil || u.Name != "alice" {
+				t.Errorf("UserByName(alice) = %+v, %v", u, err)
+			}
+		})
+		lookUp(func() {
+			if u, err := c.UserByName("bob"); err != nil || u.Name != "bob" {
+				t.Errorf("UserByName(bob) = %+v, %v", u, err)
+			}
+		})
+		lookUp(func() {
+			if u, err := c.UserByUID(2000); err != nil || u.UID != 2000 {
+				t.Errorf("UserByUID(2000) = %+v, %v", u, err)
+			}
+		})
+		lookUp(func() {
+			if names, err := c.GroupNames(PasswdEntry{Name: "alice"}); err != nil || !reflect.DeepEqual(names, []string{"alice"}) {
+				t.Errorf("GroupNames(alice) = %v, %v", names, err)
+			}
+		})
+	}
+
+	// Every different lookup starts while the others are still waiting.
+	var started []string
+	for len(started) < 4 {
+		select {
+		case name := <-d.started:
+			started = append(started, name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %v were looked up at once", started)
+		}
+	}
+	close(d.release)
+	wg.Wait()
+
+	// And the same lookup, however often it's asked for, is only done once.
+	close(d.started)
+	for name := range d.started {
+		started = append(started, name)
+	}
+	sort.Strings(started)
+	if want := []string{"2000", "alice", "bob", "groups of alice"}; !reflect.DeepEqual(started, want) {
+		t.Errorf("looked up %v, want %v", started, want)
+	}
+	// Looking alice up by name answers by UID too; another lookup would panic, since started is closed.
+	if u, err := c.UserByUID(1005); err != nil || u.Name != "alice" {
+		t.Errorf("UserByUID(1005) after UserByName(alice) = %+v, %v", u, err)
+	}
+}
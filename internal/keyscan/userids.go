@@ -3,29 +3,21 @@ package keyscan
 import (
 	"errors"
 	"os"
-	"os/user"
-	"strconv"
 	"syscall"
 )
 
-// Takes a username, returns the user's numeric ID. Doesn't work under Windows, because Windows doesn't do numeric Uids I think.
-func getUIDForUser(username string) (int, error) {
-	user, err := user.Lookup(username)
+// Takes a username, returns the user's numeric ID from the directory.
+func getUIDForUser(dir UserDirectory, username string) (int, error) {
+	u, err := dir.UserByName(username)
 	if err != nil {
 		return -1, err
 	}
-
-	uid, err := strconv.Atoi(user.Uid)
-	if err != nil {
-		return -1, err
-	}
-
-	return uid, nil
+	return u.UID, nil
 }
 
 // Takes a filename and returns the owner's username as a string.
-func getFileOwnerName(filename string) (string, error) {
-	username, _, err := getFileOwnerNameAndID(filename)
+func getFileOwnerName(dir UserDirectory, filename string) (string, error) {
+	username, _, err := getFileOwnerNameAndID(dir, filename)
 	if err != nil {
 		return "", err
 	}
@@ -33,23 +25,47 @@ func getFileOwnerName(filename string) (string, error) {
 }
 
 // Takes a filename and returns the owner's username *and* numeric ID.
-func getFileOwnerNameAndID(filename string) (string, int, error) {
-	info, err := os.Stat(filename)
+func getFileOwnerNameAndID(dir UserDirectory, filename string) (string, int, error) {
+	UID, err := getFileOwnerID(filename)
 	if err != nil {
 		return "", -1, err
 	}
 
-	var UID int
+	username, err := getUsernameForUID(dir, UID)
+	if err != nil {
+		return "", -1, err
+	}
+	return username, UID, nil
+}
+
+// Takes a filename and returns the owner's numeric ID. Doesn't work under Windows, because Windows doesn't do numeric Uids I think.
+func getFileOwnerID(filename string) (int, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return -1, err
+	}
+
 	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
-		UID = int(stat.Uid)
-	} else {
-		// This function doesn't work if the backing store doesn't support the syscalls used.
-		return "", -1, errors.New("this OS does not support syscalls providing file ownership information")
+		return int(stat.Uid), nil
 	}
+	// This function doesn't work if the backing store doesn't support the syscalls used.
+	return -1, errors.New("this OS does not support syscalls providing file ownership information")
+}
 
-	ownerUser, err := user.LookupId(strconv.FormatInt(int64(UID), 10))
+// Takes a numeric user ID and returns the username from the directory.
+func getUsernameForUID(dir UserDirectory, uid int) (string, error) {
+	u, err := dir.UserByUID(uid)
 	if err != nil {
-		return "", -1, err
+		return "", err
+	}
+	return u.Name, nil
+}
+
+// Takes a username and returns the names of all the groups the user is in, including their primary group.
+func getGroupNamesForUser(dir UserDirectory, username string) ([]string, error) {
+	u, err := dir.UserByName(username)
+	if err != nil {
+		return nil, err
 	}
-	return ownerUser.Username, UID, nil
+	return dir.GroupNames(u)
 }
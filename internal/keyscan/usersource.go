@@ -0,0 +1,101 @@
+package keyscan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A UserSource lists the accounts on a system, so that the scan can go through each of them.
+type UserSource interface {
+	Users() ([]PasswdEntry, error)
+	String() string // Where the users come from, for logs and errors
+}
+
+// NewUserSource makes a UserSource of the kind named in the config: getent (the default), passwd or json.
+// The passwd and json kinds read from path.
+func NewUserSource(kind string, path string) (UserSource, error) {
+	switch kind {
+	case "", "getent":
+		return GetentUserSource{}, nil
+	case "passwd":
+		if path == "" {
+			return nil, fmt.Errorf("user source %q needs a file", kind)
+		}
+		return PasswdFileUserSource{Path: path}, nil
+	case "json":
+		if path == "" {
+			return nil, fmt.Errorf("user source %q needs a file", kind)
+		}
+		return JSONUserSource{Path: path}, nil
+	}
+	return nil, fmt.Errorf("invalid user source %q: must be getent, passwd or json", kind)
+}
+
+// GetentUserSource lists the users in the system's passwd database, including any from LDAP and the like.
+type GetentUserSource struct{}
+
+func (GetentUserSource) Users() ([]PasswdEntry, error) {
+	return ListPasswdEntries()
+}
+
+func (GetentUserSource) String() string {
+	return "getent passwd"
+}
+
+// PasswdFileUserSource lists the users in a passwd-format file.
+type PasswdFileUserSource struct {
+	Path string
+}
+
+func (s PasswdFileUserSource) Users() ([]PasswdEntry, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParsePasswd(f)
+}
+
+func (s PasswdFileUserSource) String() string {
+	return s.Path
+}
+
+// JSONUserSource lists the users in a JSON file, which should hold an array of objects with the same
+//  fields as a passwd entry: [{"name": "alice", "uid": 1000, "gid": 1000, "home": "/home/alice", "shell": "/bin/bash"}]
+type JSONUserSource struct {
+	Path string
+}
+
+func (s JSONUserSource) Users() ([]PasswdEntry, error) {
+	contents, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]PasswdEntry, 0)
+	if err := json.Unmarshal(contents, &users); err != nil {
+		return nil, err
+	}
+	for i, u := range users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("user %d in the list has no name", i+1)
+		}
+	}
+	return users, nil
+}
+
+func (s JSONUserSource) String() string {
+	return s.Path
+}
+
+// isNologinShell returns true for shells that stop an account logging in at all, like nologin and false.
+// sshd runs even forced commands through the user's shell, so keys for these accounts can't be used.
+func isNologinShell(shell string) bool {
+	switch filepath.Base(shell) {
+	case "nologin", "false":
+		return true
+	}
+	return false
+}
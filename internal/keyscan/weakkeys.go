@@ -0,0 +1,105 @@
+package keyscan
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// blacklistSuffixLen is how many hex digits from the end of a key's MD5 fingerprint openssh-blacklist keeps.
+const blacklistSuffixLen = 20
+
+// A WeakKeyBlacklist holds the keys known to have been generated by Debian's broken OpenSSL (CVE-2008-0166),
+//  from files in the format of the openssh-blacklist package, e.g. /usr/share/ssh/blacklist.RSA-2048.
+// Each line of those is the last 20 hex digits of a key's MD5 fingerprint, and there's a file for each key
+//  type and size, but at 80 bits a match against the wrong file is vanishingly unlikely, so they're all
+//  checked together.
+type WeakKeyBlacklist struct {
+	entries map[string]FingerprintEntry // By fingerprint suffix
+}
+
+// NewWeakKeyBlacklist returns an empty WeakKeyBlacklist.
+func NewWeakKeyBlacklist() *WeakKeyBlacklist {
+	return &WeakKeyBlacklist{entries: make(map[string]FingerprintEntry)}
+}
+
+// ReadFile adds the entries in an openssh-blacklist format file, and returns how many there were.
+// Full MD5 fingerprints, with or without colons, are accepted as well. Lines starting with # are comments.
+func (bl *WeakKeyBlacklist) ReadFile(filename string) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, newFileScanError(filename, StageRead, err)
+	}
+	defer f.Close()
+
+	n := 0
+	lines := bufio.NewScanner(f)
+	for i := 1; lines.Scan(); i++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		suffix, ok := blacklistSuffix(line)
+		if !ok {
+			return n, &ScanError{Path: filename, Stage: StageParse, Err: fmt.Errorf("line %d: not a blacklist entry", i)}
+		}
+		bl.entries[suffix] = FingerprintEntry{Fingerprint: line, SourceFile: filename, SourceLine: i}
+		n++
+	}
+	if err := lines.Err(); err != nil {
+		return n, newFileScanError(filename, StageRead, err)
+	}
+	return n, nil
+}
+
+// blacklistSuffix turns a blacklist entry, or an MD5 fingerprint, into the last 20 hex digits of the fingerprint.
+func blacklistSuffix(s string) (string, bool) {
+	if len(s) > 4 && strings.EqualFold(s[:4], "MD5:") {
+		s = s[4:]
+	}
+	s = strings.ToLower(strings.Replace(s, ":", "", -1))
+	if len(s) != blacklistSuffixLen && len(s) != 2*16 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(s); err != nil {
+		return "", false
+	}
+	return s[len(s)-blacklistSuffixLen:], true
+}
+
+// Lookup returns the blacklist entry for k, if it has one. Certificates are looked up by the key they certify.
+func (bl *WeakKeyBlacklist) Lookup(k ssh.PublicKey) (FingerprintEntry, bool) {
+	if bl == nil || len(bl.entries) == 0 {
+		return FingerprintEntry{}, false
+	}
+	if cert, ok := k.(*ssh.Certificate); ok {
+		k = cert.Key
+	}
+	fp := strings.Replace(ssh.FingerprintLegacyMD5(k), ":", "", -1)
+	e, ok := bl.entries[fp[len(fp)-blacklistSuffixLen:]]
+	return e, ok
+}
+
+// Len returns the number of keys in the blacklist.
+func (bl *WeakKeyBlacklist) Len() int {
+	return len(bl.entries)
+}
+
+// GatherWeakKeyBlacklistFromFiles reads openssh-blacklist format files into the context's WeakKeyBlacklist.
+func (ctx *ScanContext) GatherWeakKeyBlacklistFromFiles(filenames []string) {
+	if ctx.WeakKeyBlacklist == nil {
+		ctx.WeakKeyBlacklist = NewWeakKeyBlacklist()
+	}
+	for _, f := range filenames {
+		n, err := ctx.WeakKeyBlacklist.ReadFile(f)
+		if err != nil {
+			ctx.recordScanErrors(asScanError(err, f, StageRead))
+		}
+		log.WithFields(log.Fields{"file": f, "entries": n}).Debug("Read weak key blacklist")
+	}
+}
@@ -0,0 +1,322 @@
+// Package ldaptest provides an in-process LDAP server holding a fixed set of entries, for trying
+//  out LDAP lookups without a real directory, in the same way net/http/httptest does for HTTP.
+package ldaptest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// A Server answers binds and searches from its entries, on a loopback address.
+// It only understands what LDAPUserDirectory sends: simple binds, StartTLS, and searches with
+//  and, or, not, equality and presence filters. Search controls, e.g. for paging, are ignored.
+type Server struct {
+	URL          string // ldap://127.0.0.1:port
+	BindDN       string // If set, binds must use this DN and BindPassword; if not, anyone can bind
+	BindPassword string
+
+	mu        sync.Mutex
+	entries   []*ldap.Entry
+	searches  int
+	tlsConfig *tls.Config // Set by StartTLS
+	listener  net.Listener
+	conns     map[net.Conn]bool // Open client connections, so Close can close them
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer starts a server with the given entries.
+func NewServer(entries ...*ldap.Entry) (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{URL: "ldap://" + l.Addr().String(), entries: entries, listener: l, conns: make(map[net.Conn]bool)}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// StartTLS lets clients use the StartTLS operation, with a new self-signed certificate for 127.0.0.1,
+//  and returns the certificate in PEM form for clients to trust.
+// From then on, binds with a password are refused until the connection is encrypted, as a server
+//  requiring confidentiality would.
+func (s *Server) StartTLS() ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ldaptest"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// AddEntry adds an entry while the server is running.
+func (s *Server) AddEntry(e *ldap.Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, e)
+}
+
+// Searches returns how many searches the server has answered, e.g. to check that lookups are cached.
+func (s *Server) Searches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.searches
+}
+
+// Close stops the server, closes any connections clients still have open, and waits for them to finish.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			s.handle(conn)
+		}()
+	}
+}
+
+// track records a new connection, unless the server has been closed.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// handle answers requests on one connection until the client unbinds or something goes wrong.
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	bound, encrypted := false, false
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id, ok := p.Children[0].Value.(int64)
+		if !ok {
+			return
+		}
+		op := p.Children[1]
+
+		var responses []*ber.Packet
+		upgrade := false
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			var code int64 = ldap.LDAPResultInvalidCredentials
+			if len(op.Children) == 3 {
+				dn, password := packetString(op.Children[1]), packetString(op.Children[2])
+				switch {
+				case password != "" && s.config() != nil && !encrypted:
+					code = ldap.LDAPResultConfidentialityRequired
+				case s.BindDN == "" || (strings.EqualFold(dn, s.BindDN) && password == s.BindPassword):
+					code, bound = ldap.LDAPResultSuccess, true
+				}
+			}
+			responses = append(responses, newResult(ldap.ApplicationBindResponse, code, ""))
+		case ldap.ApplicationExtendedRequest:
+			switch {
+			case len(op.Children) == 0 || packetString(op.Children[0]) != startTLSOID:
+				responses = append(responses, newResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError, "unsupported extended operation"))
+			case s.config() == nil || encrypted:
+				responses = append(responses, newResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultUnavailable, "StartTLS not available"))
+			default:
+				responses = append(responses, newResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess, ""))
+				upgrade = true
+			}
+		case ldap.ApplicationSearchRequest:
+			if !bound && s.BindDN != "" {
+				responses = append(responses, newResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultInvalidCredentials, "bind first"))
+				break
+			}
+			responses = s.search(op)
+		default:
+			return // Including unbind
+		}
+
+		for _, r := range responses {
+			if _, err := conn.Write(newMessage(id, r).Bytes()); err != nil {
+				return
+			}
+		}
+		if upgrade {
+			tlsConn := tls.Server(conn, s.config())
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, encrypted = tlsConn, true
+		}
+	}
+}
+
+func (s *Server) config() *tls.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tlsConfig
+}
+
+func (s *Server) search(op *ber.Packet) []*ber.Packet {
+	if len(op.Children) != 8 {
+		return []*ber.Packet{newResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError, "malformed search")}
+	}
+	base := strings.ToLower(packetString(op.Children[0]))
+	scope, ok := op.Children[1].Value.(int64)
+	if !ok {
+		return []*ber.Packet{newResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError, "malformed scope")}
+	}
+	filter := op.Children[6]
+	attributes := make([]string, 0)
+	for _, a := range op.Children[7].Children {
+		attributes = append(attributes, packetString(a))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.searches++
+	responses := make([]*ber.Packet, 0)
+	for _, e := range s.entries {
+		matches, err := filterMatches(filter, e)
+		if err != nil {
+			return []*ber.Packet{newResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError, err.Error())}
+		}
+		if matches && inScope(strings.ToLower(e.DN), base, int(scope)) {
+			responses = append(responses, newEntry(e, attributes))
+		}
+	}
+	return append(responses, newResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, ""))
+}
+
+// filterMatches checks an entry against a search filter. Attribute names are matched without regard to case,
+//  and values exactly.
+func filterMatches(f *ber.Packet, e *ldap.Entry) (bool, error) {
+	switch f.Tag {
+	case ldap.FilterAnd, ldap.FilterOr:
+		for _, c := range f.Children {
+			m, err := filterMatches(c, e)
+			if err != nil {
+				return false, err
+			}
+			if m == (f.Tag == ldap.FilterOr) {
+				return m, nil
+			}
+		}
+		return f.Tag == ldap.FilterAnd, nil
+	case ldap.FilterNot:
+		if len(f.Children) != 1 {
+			return false, errMalformedFilter
+		}
+		m, err := filterMatches(f.Children[0], e)
+		return !m, err
+	case ldap.FilterEqualityMatch:
+		if len(f.Children) != 2 {
+			return false, errMalformedFilter
+		}
+		want := packetString(f.Children[1])
+		for _, v := range e.GetEqualFoldAttributeValues(packetString(f.Children[0])) {
+			if v == want {
+				return true, nil
+			}
+		}
+		return false, nil
+	case ldap.FilterPresent:
+		return len(e.GetEqualFoldAttributeValues(packetString(f))) != 0, nil
+	}
+	return false, errUnsupportedFilter
+}
+
+// inScope checks whether dn is within scope of base. Both should be lowercase, and DNs are
+//  compared as strings, so they need to be written the same way (e.g. no spaces after commas).
+func inScope(dn, base string, scope int) bool {
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return dn == base
+	case ldap.ScopeSingleLevel:
+		i := strings.IndexByte(dn, ',')
+		return i != -1 && dn[i+1:] == base
+	}
+	return base == "" || dn == base || strings.HasSuffix(dn, ","+base)
+}
+
+// PosixAccount makes a posixAccount entry under base.
+func PosixAccount(base, name, uid, gid, home, shell string) *ldap.Entry {
+	return ldap.NewEntry("uid="+name+","+base, map[string][]string{
+		"objectClass":   {"top", "posixAccount"},
+		"uid":           {name},
+		"uidNumber":     {uid},
+		"gidNumber":     {gid},
+		"homeDirectory": {home},
+		"loginShell":    {shell},
+	})
+}
+
+// PosixGroup makes a posixGroup entry under base.
+func PosixGroup(base, name, gid string, members ...string) *ldap.Entry {
+	return ldap.NewEntry("cn="+name+","+base, map[string][]string{
+		"objectClass": {"top", "posixGroup"},
+		"cn":          {name},
+		"gidNumber":   {gid},
+		"memberUid":   members,
+	})
+}
@@ -0,0 +1,209 @@
+package ldaptest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const testBase = "dc=example,dc=org"
+
+func newTestServer(t *testing.T) *Server {
+	s, err := NewServer(
+		PosixAccount("ou=people,"+testBase, "alice", "1000", "1000", "/home/alice", "/bin/bash"),
+		PosixAccount("ou=people,"+testBase, "bob", "1001", "100", "/home/bob", "/bin/sh"),
+		PosixGroup("ou=groups,"+testBase, "admins", "200", "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func dial(t *testing.T, s *Server) *ldap.Conn {
+	c, err := ldap.DialURL(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetTimeout(5 * time.Second)
+	return c
+}
+
+func searchDNs(c *ldap.Conn, base string, scope int, filter string) ([]string, error) {
+	result, err := c.Search(ldap.NewSearchRequest(base, scope, ldap.NeverDerefAliases, 0, 0, false, filter, nil, nil))
+	if err != nil {
+		return nil, err
+	}
+	dns := make([]string, 0, len(result.Entries))
+	for _, e := range result.Entries {
+		dns = append(dns, e.DN)
+	}
+	sort.Strings(dns)
+	return dns, nil
+}
+
+func TestSearch(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	c := dial(t, s)
+	defer c.Close()
+
+	alice, bob, admins := "uid=alice,ou=people,"+testBase, "uid=bob,ou=people,"+testBase, "cn=admins,ou=groups,"+testBase
+	tests := []struct {
+		base   string
+		scope  int
+		filter string
+		want   []string
+	}{
+		{testBase, ldap.ScopeWholeSubtree, "(uid=alice)", []string{alice}},
+		{testBase, ldap.ScopeWholeSubtree, "(UID=alice)", []string{alice}},
+		{testBase, ldap.ScopeWholeSubtree, "(uid=Alice)", []string{}},
+		{testBase, ldap.ScopeWholeSubtree, "(objectClass=posixAccount)", []string{alice, bob}},
+		{testBase, ldap.ScopeWholeSubtree, "(memberUid=*)", []string{admins}},
+		{testBase, ldap.ScopeWholeSubtree, "(&(objectClass=posixAccount)(gidNumber=100))", []string{bob}},
+		{testBase, ldap.ScopeWholeSubtree, "(|(uid=bob)(memberUid=alice))", []string{admins, bob}},
+		{testBase, ldap.ScopeWholeSubtree, "(!(objectClass=posixAccount))", []string{admins}},
+		{"ou=groups," + testBase, ldap.ScopeWholeSubtree, "(objectClass=*)", []string{admins}},
+		{"ou=people," + testBase, ldap.ScopeSingleLevel, "(uid=alice)", []string{alice}},
+		{testBase, ldap.ScopeSingleLevel, "(uid=alice)", []string{}},
+		{alice, ldap.ScopeBaseObject, "(objectClass=*)", []string{alice}},
+	}
+	for _, tt := range tests {
+		got, err := searchDNs(c, tt.base, tt.scope, tt.filter)
+		if err != nil {
+			t.Errorf("%s under %s: %v", tt.filter, tt.base, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s under %s = %v, want %v", tt.filter, tt.base, got, tt.want)
+		}
+	}
+	if _, err := searchDNs(c, testBase, ldap.ScopeWholeSubtree, "(uid=a*)"); err == nil {
+		t.Error("search with an unsupported substring filter succeeded")
+	}
+	if s.Searches() != len(tests)+1 {
+		t.Errorf("Searches() = %d, want %d", s.Searches(), len(tests)+1)
+	}
+
+	result, err := c.Search(ldap.NewSearchRequest(testBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(uid=alice)", []string{"uidnumber", "homeDirectory"}, nil))
+	if err != nil || len(result.Entries) != 1 {
+		t.Fatalf("search for alice's attributes = %v, %v", result, err)
+	}
+	if e := result.Entries[0]; len(e.Attributes) != 2 || e.GetAttributeValue("uidNumber") != "1000" || e.GetAttributeValue("homeDirectory") != "/home/alice" {
+		t.Errorf("alice's attributes = %v, want just uidNumber and homeDirectory", e.Attributes)
+	}
+}
+
+func TestBind(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	s.BindDN, s.BindPassword = "cn=keyscan,"+testBase, "secret"
+	c := dial(t, s)
+	defer c.Close()
+
+	if _, err := searchDNs(c, testBase, ldap.ScopeWholeSubtree, "(uid=alice)"); err == nil {
+		t.Error("search before binding succeeded")
+	}
+	if err := c.Bind(s.BindDN, "wrong"); !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		t.Errorf("bind with the wrong password = %v, want invalid credentials", err)
+	}
+	if err := c.Bind("CN=keyscan,"+testBase, "secret"); err != nil {
+		t.Errorf("bind with the right password: %v", err)
+	}
+	if dns, err := searchDNs(c, testBase, ldap.ScopeWholeSubtree, "(uid=alice)"); err != nil || len(dns) != 1 {
+		t.Errorf("search after binding = %v, %v", dns, err)
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	c := dial(t, s)
+	if err := c.StartTLS(&tls.Config{ServerName: "127.0.0.1"}); err == nil {
+		t.Error("StartTLS succeeded before the server was set up for it")
+	}
+	c.Close()
+
+	cert, err := s.StartTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(cert) {
+		t.Fatal("StartTLS didn't return a PEM certificate")
+	}
+
+	// A password can't be sent until the connection is encrypted.
+	c = dial(t, s)
+	defer c.Close()
+	if err := c.Bind("cn=anyone", "secret"); !ldap.IsErrorWithCode(err, ldap.LDAPResultConfidentialityRequired) {
+		t.Errorf("bind before StartTLS = %v, want confidentiality required", err)
+	}
+	if err := c.StartTLS(&tls.Config{ServerName: "127.0.0.1", RootCAs: roots}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Bind("cn=anyone", "secret"); err != nil {
+		t.Errorf("bind after StartTLS: %v", err)
+	}
+	if dns, err := searchDNs(c, testBase, ldap.ScopeWholeSubtree, "(uid=bob)"); err != nil || len(dns) != 1 {
+		t.Errorf("search after StartTLS = %v, %v", dns, err)
+	}
+
+	// The certificate has to be trusted.
+	other := dial(t, s)
+	defer other.Close()
+	if err := other.StartTLS(&tls.Config{ServerName: "127.0.0.1"}); err == nil {
+		t.Error("StartTLS trusting only the system's CAs succeeded")
+	}
+}
+
+func TestCloseWithOpenConnection(t *testing.T) {
+	s := newTestServer(t)
+	c := dial(t, s)
+	defer c.Close()
+	if err := c.UnauthenticatedBind(""); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't return while a client was connected")
+	}
+	if _, err := searchDNs(c, testBase, ldap.ScopeWholeSubtree, "(uid=alice)"); err == nil {
+		t.Error("search after Close succeeded")
+	}
+}
+
+func TestInScope(t *testing.T) {
+	tests := []struct {
+		dn, base string
+		scope    int
+		want     bool
+	}{
+		{"ou=people,dc=org", "ou=people,dc=org", ldap.ScopeBaseObject, true},
+		{"uid=a,ou=people,dc=org", "ou=people,dc=org", ldap.ScopeBaseObject, false},
+		{"uid=a,ou=people,dc=org", "ou=people,dc=org", ldap.ScopeSingleLevel, true},
+		{"uid=a,ou=x,ou=people,dc=org", "ou=people,dc=org", ldap.ScopeSingleLevel, false},
+		{"ou=people,dc=org", "ou=people,dc=org", ldap.ScopeSingleLevel, false},
+		{"uid=a,ou=x,ou=people,dc=org", "ou=people,dc=org", ldap.ScopeWholeSubtree, true},
+		{"ou=people,dc=org", "ou=people,dc=org", ldap.ScopeWholeSubtree, true},
+		{"uid=a,ou=otherpeople,dc=org", "ou=people,dc=org", ldap.ScopeWholeSubtree, false},
+		{"uid=a,dc=org", "", ldap.ScopeWholeSubtree, true},
+	}
+	for _, tt := range tests {
+		if got := inScope(tt.dn, tt.base, tt.scope); got != tt.want {
+			t.Errorf("inScope(%q, %q, %d) = %v, want %v", tt.dn, tt.base, tt.scope, got, tt.want)
+		}
+	}
+}